@@ -0,0 +1,143 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"sort"
+	"syscall"
+)
+
+// POSIX ACL xattr layout, see linux/posix_acl_xattr.h
+const (
+	aclXattrVersion = 0x0002
+	aclUserObj      = 0x01
+	aclUser         = 0x02
+	aclGroupObj     = 0x04
+	aclGroup        = 0x08
+	aclMask         = 0x10
+	aclOther        = 0x20
+	aclUndefinedID  = 0xffffffff
+)
+
+// setACL replaces the access ACL of a file with its mode bits plus entries,
+// telling if it changed. The group bits of a file with an ACL are its mask,
+// the owning group keeps the permissions of its ACL entry.
+func setACL(p string, mode os.FileMode, entries []aclEntry) (bool, error) {
+	buf := make([]byte, 4096)
+	n, err := syscall.Getxattr(p, "system.posix_acl_access", buf)
+	if err == syscall.ENODATA {
+		n, err = 0, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	current := buf[:n]
+	perm := mode.Perm()
+	group, ok := aclGroupPerm(current)
+	if !ok {
+		group = uint16(perm >> 3 & 07)
+	}
+	acl := aclXattr(uint16(perm>>6&07), group, uint16(perm&07), entries)
+	if bytes.Equal(current, acl) {
+		return false, nil
+	}
+	return true, syscall.Setxattr(p, "system.posix_acl_access", acl, 0)
+}
+
+// aclGroupPerm is the permissions of the owning group in an ACL xattr
+func aclGroupPerm(xattr []byte) (uint16, bool) {
+	if len(xattr) < 4 || binary.LittleEndian.Uint32(xattr) != aclXattrVersion {
+		return 0, false
+	}
+	for b := xattr[4:]; len(b) >= 8; b = b[8:] {
+		if binary.LittleEndian.Uint16(b) == aclGroupObj {
+			return binary.LittleEndian.Uint16(b[2:]), true
+		}
+	}
+	return 0, false
+}
+
+// aclXattr encodes an access ACL of the owner, group and other permissions
+// plus entries
+func aclXattr(user, group, other uint16, entries []aclEntry) []byte {
+	type xattrEntry struct {
+		tag  uint16
+		perm uint16
+		id   uint32
+	}
+	mask := group
+	xattr := []xattrEntry{
+		{aclUserObj, user, aclUndefinedID},
+		{aclGroupObj, group, aclUndefinedID},
+		{aclOther, other, aclUndefinedID},
+	}
+	for _, e := range entries {
+		tag := uint16(aclUser)
+		if e.Group {
+			tag = aclGroup
+		}
+		xattr = append(xattr, xattrEntry{tag, uint16(e.Perm & 07), uint32(e.ID)})
+		mask |= uint16(e.Perm & 07)
+	}
+	xattr = append(xattr, xattrEntry{aclMask, mask, aclUndefinedID})
+	sort.SliceStable(xattr, func(i, j int) bool {
+		if xattr[i].tag != xattr[j].tag {
+			return xattr[i].tag < xattr[j].tag
+		}
+		return xattr[i].id < xattr[j].id
+	})
+
+	buf := make([]byte, 4+8*len(xattr))
+	binary.LittleEndian.PutUint32(buf, aclXattrVersion)
+	for i, e := range xattr {
+		b := buf[4+8*i:]
+		binary.LittleEndian.PutUint16(b, e.tag)
+		binary.LittleEndian.PutUint16(b[2:], e.perm)
+		binary.LittleEndian.PutUint32(b[4:], e.id)
+	}
+	return buf
+}
+
+// aclXattrs are the xattrs POSIX ACLs are kept in
+var aclXattrs = []string{"system.posix_acl_access", "system.posix_acl_default"}
+
+// infoOwner is the owner and group of info
+func infoOwner(info os.FileInfo) (int, int, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return -1, -1, false
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
+
+// copyOwner gives target the owner and group of info
+func copyOwner(target string, info os.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return syscall.ENOTSUP
+	}
+	return os.Lchown(target, int(stat.Uid), int(stat.Gid))
+}
+
+// copyACL gives target the ACLs of src
+func copyACL(src, target string) error {
+	for _, name := range aclXattrs {
+		buf := make([]byte, 4096)
+		n, err := syscall.Getxattr(src, name, buf)
+		if err == syscall.ENODATA || err == syscall.ENOTSUP {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = syscall.Setxattr(target, name, buf[:n], 0)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func setACL(p string, mode os.FileMode, entries []aclEntry) (bool, error) {
+	return false, fmt.Errorf("ACLs are not supported on this platform")
+}
+
+func infoOwner(info os.FileInfo) (int, int, bool) {
+	return -1, -1, false
+}
+
+func copyOwner(target string, info os.FileInfo) error {
+	return nil
+}
+
+func copyACL(src, target string) error {
+	return nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// auditRecord is an action of the worker on a case. Hash is the SHA-256 of
+// the record encoded with an empty Hash, and Prev the Hash of the record
+// before it, so editing, removing or reordering records breaks the chain.
+type auditRecord struct {
+	Seq     uint64            `json:"seq"`
+	Time    string            `json:"time"`
+	Job     string            `json:"job"`
+	Attempt int               `json:"attempt"`
+	Action  string            `json:"action"`
+	Details map[string]string `json:"details,omitempty"`
+	Prev    string            `json:"prev"`
+	Hash    string            `json:"hash"`
+}
+
+func (r auditRecord) digest() (string, error) {
+	r.Hash = ""
+	j, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(j)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// auditHead is the last record of an audit log, kept in a separate file to
+// detect a truncated log
+type auditHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// auditLog is the append-only audit trail of a case, a JSON record per line
+// in <case folder>.audit.jsonl with its head in .audit.jsonl.head. Records
+// of every job and attempt on the case continue the same chain.
+type auditLog struct {
+	mu      sync.Mutex
+	path    string
+	job     string
+	attempt int
+	last    auditHead
+}
+
+// auditPath is the audit log next to a case folder
+func auditPath(ipedfolder string) string {
+	return filepath.Clean(ipedfolder) + ".audit.jsonl"
+}
+
+// openAuditLog continues the chain of the audit log at path, creating it if
+// it does not exist. The chain is checked and continued from its last record,
+// a broken chain is not extended.
+func openAuditLog(path, job string, attempt int) (*auditLog, error) {
+	a := &auditLog{path: path, job: job, attempt: attempt}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	a.last, err = readAuditChain(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid audit log %s: %v", path, err)
+	}
+	return a, nil
+}
+
+// record appends an action, nil-safe
+func (a *auditLog) record(action string, details map[string]string) error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	r := auditRecord{
+		Seq:     a.last.Seq + 1,
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Job:     a.job,
+		Attempt: a.attempt,
+		Action:  action,
+		Details: details,
+		Prev:    a.last.Hash,
+	}
+	var err error
+	r.Hash, err = r.digest()
+	if err != nil {
+		return err
+	}
+	j, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(j, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	a.last = auditHead{Seq: r.Seq, Hash: r.Hash}
+	return a.writeHead()
+}
+
+func (a *auditLog) writeHead() error {
+	j, err := json.Marshal(a.last)
+	if err != nil {
+		return err
+	}
+	tmp := a.path + ".head.tmp"
+	err = ioutil.WriteFile(tmp, append(j, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path+".head")
+}
+
+// log records an action, logging instead of failing the job if it can't
+func (a *auditLog) log(action string, details map[string]string) {
+	err := a.record(action, details)
+	if err != nil {
+		logger.Error("could not write the audit log", "action", action, "err", err)
+	}
+}
+
+// head is the hash of the last record, nil-safe
+func (a *auditLog) head() string {
+	if a == nil {
+		return ""
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.last.Hash
+}
+
+// moveNextTo moves the audit log next to the moved case folder
+func (a *auditLog) moveNextTo(ipedfolder string) error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	dst := auditPath(ipedfolder)
+	if dst == a.path {
+		return nil
+	}
+	_, err := moveCase(a.path, dst)
+	if err != nil {
+		return err
+	}
+	_, err = moveCase(a.path+".head", dst+".head")
+	if err != nil {
+		return err
+	}
+	a.path = dst
+	return nil
+}
+
+// verifyAudit checks the chain of an audit log and that it ends at its head,
+// returning the number of records and the last hash
+func verifyAudit(path string) (uint64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	last, err := readAuditChain(f)
+	if err != nil {
+		return last.Seq, last.Hash, err
+	}
+
+	j, err := ioutil.ReadFile(path + ".head")
+	if err != nil {
+		return last.Seq, last.Hash, fmt.Errorf("could not read the head: %v", err)
+	}
+	var head auditHead
+	err = json.Unmarshal(j, &head)
+	if err != nil {
+		return last.Seq, last.Hash, fmt.Errorf("invalid head: %v", err)
+	}
+	if head != last {
+		return last.Seq, last.Hash, fmt.Errorf("the log ends at record %d but the head is record %d %s, the log was truncated or replaced", last.Seq, head.Seq, head.Hash)
+	}
+	return last.Seq, last.Hash, nil
+}
+
+// readAuditChain checks the records of an audit log follow each other,
+// returning the last valid one
+func readAuditChain(r io.Reader) (auditHead, error) {
+	last := auditHead{}
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		b, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(b) == 0 {
+			return last, nil
+		}
+		if err == io.EOF {
+			return last, fmt.Errorf("line %d: incomplete record, the log was truncated", line)
+		}
+		if err != nil {
+			return last, err
+		}
+		var r auditRecord
+		err = json.Unmarshal(b, &r)
+		if err != nil {
+			return last, fmt.Errorf("line %d: invalid record: %v", line, err)
+		}
+		if r.Seq != last.Seq+1 {
+			return last, fmt.Errorf("line %d: expected seq %d, got %d", line, last.Seq+1, r.Seq)
+		}
+		if r.Prev != last.Hash {
+			return last, fmt.Errorf("line %d: record does not follow the previous one", line)
+		}
+		digest, err := r.digest()
+		if err != nil {
+			return last, err
+		}
+		if digest != r.Hash {
+			return last, fmt.Errorf("line %d: record was modified", line)
+		}
+		last = auditHead{Seq: r.Seq, Hash: r.Hash}
+	}
+}
+
+// auditCommand runs "audit verify <file>..." and returns the exit code
+func auditCommand(args []string, w io.Writer) int {
+	if len(args) < 2 || args[0] != "verify" {
+		fmt.Fprintln(w, "usage: worker audit verify <file>...")
+		return 2
+	}
+	code := 0
+	for _, path := range args[1:] {
+		records, head, err := verifyAudit(path)
+		if err != nil {
+			fmt.Fprintf(w, "%s: FAILED after %d records: %v\n", path, records, err)
+			code = 1
+			continue
+		}
+		fmt.Fprintf(w, "%s: OK, %d records, head %s\n", path, records, head)
+	}
+	return code
+}
+
+// fileHashes are the SHA-256 of files below dir matching patterns, by path
+// relative to dir
+func fileHashes(dir string, patterns ...string) (map[string]string, error) {
+	hashes := map[string]string{}
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range matches {
+			sum, err := sha256File(p)
+			if err != nil {
+				return nil, err
+			}
+			rel, _ := filepath.Rel(dir, p)
+			hashes[rel] = sum
+		}
+	}
+	return hashes, nil
+}
+
+func sha256File(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
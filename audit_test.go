@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func writeAudit(t *testing.T, dir string) string {
+	p := auditPath(filepath.Join(dir, "SARD"))
+	a, err := openAuditLog(p, "job1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, action := range []string{"start", "lock", "mkdir"} {
+		if err := a.record(action, map[string]string{"path": "/data/SARD"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a retry continues the chain
+	a, err = openAuditLog(p, "job1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.record("unlock", nil); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := writeAudit(t, dir)
+	if filepath.Base(p) != "SARD.audit.jsonl" {
+		t.Errorf("expected the audit log next to the case, got: %s", p)
+	}
+
+	records, head, err := verifyAudit(p)
+	if err != nil || records != 4 || head == "" {
+		t.Fatalf("expected 4 valid records, got: %d %s %v", records, head, err)
+	}
+
+	original, _ := ioutil.ReadFile(p)
+	lines := strings.SplitAfter(string(original), "\n")
+	tests := []struct {
+		name     string
+		contents string
+		expected string
+	}{
+		{"edited", strings.Replace(string(original), `"lock"`, `"mkdir"`, 1), "line 2: record was modified"},
+		{"removed", lines[0] + lines[2] + lines[3], "line 2: expected seq 2, got 3"},
+		{"truncated", lines[0] + lines[1] + lines[2], "truncated or replaced"},
+		{"cut", string(original[:len(original)-10]), "line 4: incomplete record"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ioutil.WriteFile(p, []byte(test.contents), 0644)
+			_, _, err := verifyAudit(p)
+			if err == nil || !strings.Contains(err.Error(), test.expected) {
+				t.Errorf("expected: %s, got: %v", test.expected, err)
+			}
+		})
+	}
+
+	ioutil.WriteFile(p, original, 0644)
+	os.Remove(p + ".head")
+	if _, _, err := verifyAudit(p); err == nil {
+		t.Error("expected an error without the head")
+	}
+}
+
+func TestAuditCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := writeAudit(t, dir)
+
+	var out bytes.Buffer
+	if code := auditCommand([]string{"verify", p}, &out); code != 0 || !strings.Contains(out.String(), "OK, 4 records") {
+		t.Errorf("expected a valid log, got: %d %s", code, out.String())
+	}
+	out.Reset()
+	if code := auditCommand([]string{"verify", p, filepath.Join(dir, "missing.jsonl")}, &out); code != 1 || !strings.Contains(out.String(), "FAILED") {
+		t.Errorf("expected a failure, got: %d %s", code, out.String())
+	}
+	if code := auditCommand(nil, &out); code != 2 {
+		t.Errorf("expected usage, got: %d", code)
+	}
+}
+
+func TestAuditMove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := writeAudit(t, dir)
+	a, err := openAuditLog(p, "job1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Mkdir(filepath.Join(dir, "cases"), 0755)
+	err = a.moveNextTo(filepath.Join(dir, "cases", "SARD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.record("done", nil)
+	records, _, err := verifyAudit(filepath.Join(dir, "cases", "SARD.audit.jsonl"))
+	if err != nil || records != 5 {
+		t.Errorf("expected 5 valid records after the move, got: %d %v", records, err)
+	}
+}
+
+func TestAuditOpenChecksChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := writeAudit(t, dir)
+	original, _ := ioutil.ReadFile(p)
+
+	// the head comes from the log, a stale or missing sidecar is rewritten
+	os.Remove(p + ".head")
+	a, err := openAuditLog(p, "job1", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.record("start", nil)
+	if records, _, err := verifyAudit(p); err != nil || records != 5 {
+		t.Errorf("expected 5 valid records, got: %d %v", records, err)
+	}
+
+	ioutil.WriteFile(p, []byte(strings.Replace(string(original), `"lock"`, `"mkdir"`, 1)), 0644)
+	if _, err := openAuditLog(p, "job1", 3); err == nil || !strings.Contains(err.Error(), "record was modified") {
+		t.Errorf("expected a broken chain not to be continued, got: %v", err)
+	}
+}
+
+func TestAuditOnlyWithLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	status := http.StatusConflict
+	lockService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer lockService.Close()
+	params := ipedParams{id: "job1", attempt: 1, evidence: filepath.Join(dir, "hd.E01"), output: "SARD"}
+	p := auditPath(caseFolder(params))
+
+	called := false
+	err = withLocker(context.Background(), &params, &remoteLocker{URL: lockService.URL}, func() error {
+		called = true
+		return nil
+	})
+	if err == nil || called {
+		t.Fatalf("expected the lock to fail, got: %v", err)
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Errorf("expected no audit log without the lock, got: %v", err)
+	}
+
+	status = http.StatusOK
+	err = withLocker(context.Background(), &params, &remoteLocker{URL: lockService.URL}, func() error {
+		return params.audit.record("mkdir", nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records, _, err := verifyAudit(p); err != nil || records != 4 {
+		t.Errorf("expected start, lock, mkdir and unlock, got: %d %v", records, err)
+	}
+}
+
+func TestAuditNextHolderContinuesChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	first := ipedParams{id: "job1", attempt: 1, evidence: filepath.Join(dir, "hd.E01"), output: "SARD"}
+	second := ipedParams{id: "job2", attempt: 1, evidence: first.evidence, output: "SARD"}
+	p := auditPath(caseFolder(first))
+
+	// the second worker takes the lock as soon as the first releases it,
+	// before the first worker gets the answer to its unlock
+	var unlocks int32
+	var secondErr error
+	var lockService *httptest.Server
+	lockService = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e event
+		json.NewDecoder(r.Body).Decode(&e)
+		if e.Type == "UNLOCK" && atomic.AddInt32(&unlocks, 1) == 1 {
+			secondErr = withLocker(context.Background(), &second, &remoteLocker{URL: lockService.URL}, func() error {
+				return second.audit.record("mkdir", nil)
+			})
+		}
+	}))
+	defer lockService.Close()
+
+	err = withLocker(context.Background(), &first, &remoteLocker{URL: lockService.URL}, func() error {
+		return failure("iped", errors.New("exit status 1"))
+	})
+	if failureReason(err) != "iped" {
+		t.Fatalf("expected the iped failure, got: %v", err)
+	}
+	if secondErr != nil {
+		t.Fatal(secondErr)
+	}
+	records, _, err := verifyAudit(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records != 8 {
+		t.Errorf("expected 8 records, got %d", records)
+	}
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var r auditRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatal(err)
+		}
+		actions = append(actions, r.Job+":"+r.Action)
+	}
+	expected := "job1:start job1:lock job1:failed job1:unlock job2:start job2:lock job2:mkdir job2:unlock"
+	if got := strings.Join(actions, " "); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// brokerMessage is a delivery of a job message. Attempt counts its
+// deliveries, starting at 1.
+type brokerMessage struct {
+	Body    []byte
+	Attempt int
+	Ack     func() error
+	// Requeue puts the message back in the queue, to be delivered as attempt
+	Requeue func(attempt int) error
+	// Reject drops the message, or dead-letters it if the queue has one
+	Reject func() error
+	// Lost is closed when the broker takes the message back before it is
+	// settled, e.g. after its consumer timeout, to deliver it again
+	Lost <-chan struct{}
+}
+
+// broker is a queue shared by a fleet of workers
+type broker interface {
+	// Get takes the next message, false if the queue is empty
+	Get() (brokerMessage, bool, error)
+	Close() error
+}
+
+// brokerSource runs the jobs of a broker queue with at-least-once semantics:
+// a message is acked only after its job finishes, requeued after a transient
+// failure, and rejected (dead-lettered, if the queue has one) after any
+// other failure or maxAttempts deliveries. A message stays unacked for the
+// whole run, a broker that takes it back meanwhile is reported as an error.
+type brokerSource struct {
+	broker      broker
+	defaults    Job
+	interval    time.Duration
+	retryDelay  time.Duration
+	maxAttempts int
+}
+
+func (s *brokerSource) Run(ctx context.Context, jobs chan<- queuedJob, ready func() bool) {
+	defer close(jobs)
+	defer liveness.stop("broker")
+	for {
+		liveness.beat("broker")
+		if ready() {
+			job, ok, err := s.next()
+			if err != nil {
+				logger.Error("could not get a job from the broker", "err", err)
+			}
+			if ok {
+				if !offer(ctx, jobs, job, "broker") {
+					return
+				}
+				// the job has its slot, another one may fit
+				continue
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.interval):
+		}
+	}
+}
+
+// next gets a message with a valid job, rejecting invalid ones
+func (s *brokerSource) next() (queuedJob, bool, error) {
+	for {
+		msg, ok, err := s.broker.Get()
+		if err != nil || !ok {
+			return queuedJob{}, false, err
+		}
+		var job Job
+		err = json.Unmarshal(msg.Body, &job)
+		if err == nil && job.EvidencePath == "" {
+			err = fmt.Errorf("evidencePath not set")
+		}
+		if err != nil {
+			logger.Error("rejecting invalid job message", "err", err, "body", string(msg.Body))
+			msg.Reject()
+			continue
+		}
+		if job.ID == "" {
+			job.ID = newJobID()
+		}
+		job = withDefaults(job, s.defaults)
+		logger.Info("received job", "job", job.ID, "evidence", job.EvidencePath, "attempt", msg.Attempt)
+		settled := watchLost(job, msg)
+		settle := s.settle(job, msg)
+		return queuedJob{
+			Job:     job,
+			attempt: msg.Attempt,
+			finished: func(err error) {
+				settled()
+				settle(err)
+			},
+			scheduled: make(chan struct{}),
+			release: func() {
+				settled()
+				// the job did not start, its next delivery is the same attempt
+				err := msg.Requeue(msg.Attempt)
+				if err != nil {
+					logger.Error("could not release the job message", "job", job.ID, "err", err)
+				}
+			},
+		}, true, nil
+	}
+}
+
+// watchLost reports a message the broker takes back while its job runs: the
+// job runs again on another worker and its ack fails. It returns the function
+// that stops watching once the message is settled.
+func watchLost(job Job, msg brokerMessage) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-msg.Lost:
+			logger.Error("the broker took back the message of a running job, it will be delivered again; the consumer timeout of the queue must exceed the longest job, see BROKER_CONSUMER_TIMEOUT",
+				"job", job.ID, "attempt", msg.Attempt)
+		case <-done:
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// settle acks or nacks a message with the result of its job
+func (s *brokerSource) settle(job Job, msg brokerMessage) func(error) {
+	return func(err error) {
+		var serr error
+		switch {
+		case err == nil:
+			serr = msg.Ack()
+		case isTransient(err) && (s.maxAttempts <= 0 || msg.Attempt < s.maxAttempts):
+			logger.Warn("job failed, requeueing", "job", job.ID, "attempt", msg.Attempt, "retryIn", s.retryDelay.String(), "err", err)
+			// leave the message unacked for a while, so the queue is not
+			// spun while a service is down
+			time.AfterFunc(s.retryDelay, func() {
+				err := msg.Requeue(msg.Attempt + 1)
+				if err != nil {
+					logger.Error("could not requeue the job message", "job", job.ID, "err", err)
+				}
+			})
+		default:
+			logger.Error("job failed, rejecting its message", "job", job.ID, "attempt", msg.Attempt, "err", err)
+			serr = msg.Reject()
+		}
+		if serr != nil {
+			logger.Error("could not settle the job message", "job", job.ID, "err", serr)
+		}
+	}
+}
+
+// memoryBroker is an in-process broker, for tests and trying things out
+type memoryBroker struct {
+	mu       sync.Mutex
+	ready    []memoryMessage
+	unacked  int
+	rejected [][]byte
+	// expiries take back the unacked messages
+	expiries map[int]func()
+	next     int
+}
+
+type memoryMessage struct {
+	body       []byte
+	deliveries int
+}
+
+func newMemoryBroker() *memoryBroker {
+	return &memoryBroker{}
+}
+
+func (b *memoryBroker) Publish(body []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ready = append(b.ready, memoryMessage{body: body})
+}
+
+func (b *memoryBroker) Get() (brokerMessage, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.ready) == 0 {
+		return brokerMessage{}, false, nil
+	}
+	m := b.ready[0]
+	b.ready = b.ready[1:]
+	m.deliveries++
+	b.unacked++
+	if b.expiries == nil {
+		b.expiries = map[int]func(){}
+	}
+	b.next++
+	id := b.next
+	settled, lost := false, make(chan struct{})
+	settle := func() error {
+		if settled {
+			select {
+			case <-lost:
+				return fmt.Errorf("message taken back by the broker")
+			default:
+			}
+			return fmt.Errorf("message already settled")
+		}
+		settled = true
+		b.unacked--
+		delete(b.expiries, id)
+		return nil
+	}
+	b.expiries[id] = func() {
+		settle()
+		b.ready = append(b.ready, m)
+		close(lost)
+	}
+	return brokerMessage{
+		Body:    m.body,
+		Attempt: m.deliveries,
+		Ack: func() error {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			return settle()
+		},
+		Requeue: func(attempt int) error {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			err := settle()
+			if err != nil {
+				return err
+			}
+			m.deliveries = attempt - 1
+			b.ready = append(b.ready, m)
+			return nil
+		},
+		Reject: func() error {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			err := settle()
+			if err != nil {
+				return err
+			}
+			b.rejected = append(b.rejected, m.body)
+			return nil
+		},
+		Lost: lost,
+	}, true, nil
+}
+
+// expire takes back the unacked messages, to be delivered again, as a broker
+// does when their consumer timeout elapses
+func (b *memoryBroker) expire() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, f := range b.expiries {
+		f()
+	}
+}
+
+func (b *memoryBroker) Close() error {
+	return nil
+}
+
+// attemptHeader counts the attempts of a message the worker requeued
+const attemptHeader = "x-ipedworker-attempt"
+
+// amqpBroker gets jobs from an AMQP 0-9-1 queue (e.g. RabbitMQ), polling with
+// basic.get so a worker only takes the jobs it can start. It reopens the
+// channel when the broker closes it, and reconnects on the next Get after
+// the connection is lost. A message is requeued by publishing it again with
+// its attempt in a header, confirmed by the broker before the delivery is
+// acked, so classic queues count attempts too.
+//
+// Deliveries stay unacked while their job runs, which takes hours. The
+// broker takes back a delivery unacked for longer than its consumer timeout
+// (30 minutes by default in RabbitMQ) by closing the channel, so a queue the
+// worker declares gets ConsumerTimeout as its x-consumer-timeout argument.
+// An existing queue needs a consumer-timeout policy instead.
+type amqpBroker struct {
+	mu              sync.Mutex
+	URL             string
+	Queue           string
+	ConsumerTimeout time.Duration
+	conn            *amqp.Connection
+	channel         *amqp.Channel
+	// lost is closed with channel, its deliveries are back in the queue
+	lost chan struct{}
+}
+
+func newAMQPBroker(URL, queue string, consumerTimeout time.Duration) (*amqpBroker, error) {
+	b := &amqpBroker{URL: URL, Queue: queue, ConsumerTimeout: consumerTimeout}
+	return b, b.connect()
+}
+
+func (b *amqpBroker) connect() error {
+	conn, err := amqp.Dial(b.URL)
+	if err != nil {
+		return err
+	}
+	b.conn = conn
+	err = b.openChannel()
+	if err != nil {
+		conn.Close()
+		b.conn = nil
+	}
+	return err
+}
+
+func (b *amqpBroker) openChannel() error {
+	channel, err := b.conn.Channel()
+	if err != nil {
+		return err
+	}
+	err = channel.Confirm(false)
+	if err == nil {
+		var args amqp.Table
+		if b.ConsumerTimeout > 0 {
+			args = amqp.Table{"x-consumer-timeout": int64(b.ConsumerTimeout / time.Millisecond)}
+		}
+		_, err = channel.QueueDeclare(b.Queue, true, false, false, false, args)
+		if aerr, ok := err.(*amqp.Error); ok && aerr.Code == amqp.PreconditionFailed {
+			err = fmt.Errorf("queue %s exists with other arguments, give it a consumer-timeout policy of at least the longest job and set BROKER_CONSUMER_TIMEOUT=0: %v", b.Queue, err)
+		}
+	}
+	if err != nil {
+		channel.Close()
+		return err
+	}
+	closed := channel.NotifyClose(make(chan *amqp.Error, 1))
+	lost := make(chan struct{})
+	go func() {
+		err, ok := <-closed
+		if ok {
+			logger.Warn("the amqp channel was closed", "queue", b.Queue, "err", err)
+		}
+		close(lost)
+	}()
+	b.channel = channel
+	b.lost = lost
+	return nil
+}
+
+// channelClosed tells if the channel was closed, by the broker after a
+// precondition failed or a consumer timeout, or with the connection
+func (b *amqpBroker) channelClosed() bool {
+	select {
+	case <-b.lost:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *amqpBroker) Get() (brokerMessage, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var err error
+	switch {
+	case b.conn == nil || b.conn.IsClosed():
+		err = b.connect()
+	case b.channelClosed():
+		err = b.openChannel()
+	}
+	if err != nil {
+		return brokerMessage{}, false, err
+	}
+	channel, lost := b.channel, b.lost
+	d, ok, err := channel.Get(b.Queue, false)
+	if err != nil || !ok {
+		return brokerMessage{}, false, err
+	}
+	return brokerMessage{
+		Body:    d.Body,
+		Attempt: amqpAttempt(d),
+		Ack: func() error {
+			select {
+			case <-lost:
+				return fmt.Errorf("the channel of the delivery was closed, the broker requeued it")
+			default:
+			}
+			return d.Ack(false)
+		},
+		Requeue: func(attempt int) error {
+			return b.requeue(channel, d, attempt)
+		},
+		Reject: func() error {
+			return d.Nack(false, false)
+		},
+		Lost: lost,
+	}, true, nil
+}
+
+// requeue publishes a delivery again as attempt, then acks it. A delivery of
+// a closed channel was already requeued by the broker.
+func (b *amqpBroker) requeue(channel *amqp.Channel, d amqp.Delivery, attempt int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if channel != b.channel || channel.IsClosed() {
+		return fmt.Errorf("the channel of the delivery was closed, the broker requeues it")
+	}
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	delete(headers, "x-delivery-count")
+	headers[attemptHeader] = int32(attempt)
+	// the user id is left out, the broker checks it against the connection
+	confirm, err := channel.PublishWithDeferredConfirm("", b.Queue, false, false, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		Expiration:      d.Expiration,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	})
+	if err != nil {
+		return err
+	}
+	if !confirm.Wait() {
+		return fmt.Errorf("the broker did not take the requeued message")
+	}
+	return d.Ack(false)
+}
+
+// amqpAttempt is the attempt of a delivery: the attempt header set when the
+// worker requeued it, plus the deliveries the broker counted since, e.g.
+// after a worker was lost. Quorum queues count them in x-delivery-count,
+// classic queues only tell if the message was delivered before.
+func amqpAttempt(d amqp.Delivery) int {
+	attempt, ok := tableInt(d.Headers, attemptHeader)
+	if !ok || attempt < 1 {
+		attempt = 1
+	}
+	if count, ok := tableInt(d.Headers, "x-delivery-count"); ok {
+		return attempt + count
+	}
+	if d.Redelivered {
+		return attempt + 1
+	}
+	return attempt
+}
+
+func tableInt(t amqp.Table, key string) (int, bool) {
+	switch v := t[key].(type) {
+	case int64:
+		return int(v), true
+	case int32:
+		return int(v), true
+	case int16:
+		return int(v), true
+	case int8:
+		return int(v), true
+	case uint8:
+		return int(v), true
+	case uint16:
+		return int(v), true
+	case uint32:
+		return int(v), true
+	}
+	return 0, false
+}
+
+func (b *amqpBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		return nil
+	}
+	return b.conn.Close()
+}
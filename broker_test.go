@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestBrokerSource(t *testing.T) {
+	b := newMemoryBroker()
+	b.Publish([]byte(`{"evidencePath": "/data/a.E01"}`))
+	b.Publish([]byte(`not a job`))
+	b.Publish([]byte(`{"id": "b", "evidencePath": "/data/b.E01"}`))
+	s := &brokerSource{broker: b, defaults: Job{Profile: "forensic"}, retryDelay: time.Millisecond, maxAttempts: 2}
+
+	job, ok, err := s.next()
+	if err != nil || !ok {
+		t.Fatalf("expected a job, got: %v %v", ok, err)
+	}
+	if job.EvidencePath != "/data/a.E01" || job.Profile != "forensic" || job.ID == "" || job.attempt != 1 {
+		t.Errorf("unexpected job: %+v %d", job.Job, job.attempt)
+	}
+	job.finished(nil)
+
+	job, _, _ = s.next()
+	if job.ID != "b" {
+		t.Fatalf("expected the invalid message to be skipped, got: %+v", job.Job)
+	}
+	if len(b.rejected) != 1 || string(b.rejected[0]) != "not a job" {
+		t.Errorf("expected the invalid message to be rejected, got: %q", b.rejected)
+	}
+
+	// a transient failure is retried until maxAttempts
+	job.finished(transientFailure("lock", fmt.Errorf("connection refused")))
+	time.Sleep(20 * time.Millisecond)
+	job, ok, _ = s.next()
+	if !ok || job.ID != "b" || job.attempt != 2 {
+		t.Fatalf("expected the job to be requeued, got: %v %+v %d", ok, job.Job, job.attempt)
+	}
+	job.finished(transientFailure("lock", fmt.Errorf("connection refused")))
+	if _, ok, _ := s.next(); ok {
+		t.Error("expected the job not to be requeued after maxAttempts")
+	}
+	if len(b.rejected) != 2 || b.unacked != 0 {
+		t.Errorf("expected the job to be rejected, got: %d rejected, %d unacked", len(b.rejected), b.unacked)
+	}
+
+	// other failures are not retried
+	b.Publish([]byte(`{"evidencePath": "/data/c.E01"}`))
+	job, _, _ = s.next()
+	job.finished(failure("iped", fmt.Errorf("exit status 1")))
+	if len(b.rejected) != 3 || len(b.ready) != 0 {
+		t.Errorf("expected the job to be rejected, got: %d rejected, %d ready", len(b.rejected), len(b.ready))
+	}
+}
+
+func TestBrokerSourceLostMessage(t *testing.T) {
+	var buf syncBuffer
+	l, err := newLogger(&buf, "text", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := logger
+	logger = l
+	defer func() { logger = saved }()
+
+	b := newMemoryBroker()
+	b.Publish([]byte(`{"id": "a", "evidencePath": "/data/a.E01"}`))
+	s := &brokerSource{broker: b, maxAttempts: 2}
+	running, _, _ := s.next()
+
+	// the consumer timeout elapses while the job runs
+	b.expire()
+	for i := 0; i < 100 && !strings.Contains(buf.String(), "took back"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(buf.String(), "the broker took back the message of a running job") || !strings.Contains(buf.String(), "job=a") {
+		t.Errorf("expected the lost message to be reported, got: %s", buf.String())
+	}
+	again, ok, _ := s.next()
+	if !ok || again.ID != "a" || again.attempt != 2 {
+		t.Fatalf("expected the job to be delivered again, got: %v %+v %d", ok, again.Job, again.attempt)
+	}
+
+	// the first run can't ack a message it lost
+	running.finished(nil)
+	if b.unacked != 1 || len(b.ready) != 0 {
+		t.Errorf("expected only the redelivery unacked, got: %d unacked, %d ready", b.unacked, len(b.ready))
+	}
+	if !strings.Contains(buf.String(), "could not settle the job message") {
+		t.Errorf("expected the failed ack to be reported, got: %s", buf.String())
+	}
+	again.finished(nil)
+	if b.unacked != 0 {
+		t.Errorf("expected the redelivery to be acked, got: %d unacked", b.unacked)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestBrokerSourceRun(t *testing.T) {
+	b := newMemoryBroker()
+	b.Publish([]byte(`{"evidencePath": "/data/a.E01"}`))
+	s := &brokerSource{broker: b, interval: 10 * time.Millisecond}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	jobs := make(chan queuedJob)
+	ready := false
+	go s.Run(ctx, jobs, func() bool { return ready })
+	time.Sleep(50 * time.Millisecond)
+	if len(b.ready) != 1 {
+		t.Fatal("expected no job to be taken while not ready")
+	}
+	cancel()
+	<-jobs
+
+	// nobody takes the job, stopping puts it back
+	ctx, cancel = context.WithCancel(context.Background())
+	jobs = make(chan queuedJob)
+	go s.Run(ctx, jobs, func() bool { return true })
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-jobs
+	if len(b.ready) != 1 || b.unacked != 0 {
+		t.Errorf("expected the job back in the queue, got: %d ready, %d unacked", len(b.ready), b.unacked)
+	}
+}
+
+// fakeAMQP is enough of an AMQP 0-9-1 server for amqpBroker: one queue with
+// basic.get, acks, nacks, publishes with confirms, and channels it can close
+type fakeAMQP struct {
+	listener net.Listener
+	mu       sync.Mutex
+	queue    []fakeAMQPMessage
+	rejected [][]byte
+	conns    []*fakeAMQPConn
+	// declared are the arguments of the last queue.declare, as a field table
+	declared []byte
+}
+
+type fakeAMQPMessage struct {
+	// props are the property flags and properties of the content header
+	props       []byte
+	body        []byte
+	redelivered bool
+}
+
+type fakeAMQPConn struct {
+	server   *fakeAMQP
+	conn     net.Conn
+	writeMu  sync.Mutex
+	channels map[uint16]*fakeAMQPChannel
+}
+
+type fakeAMQPChannel struct {
+	unacked  map[uint64]fakeAMQPMessage
+	tag      uint64
+	confirm  bool
+	seq      uint64
+	incoming *fakeAMQPMessage
+	size     uint64
+}
+
+func newFakeAMQP(t *testing.T) *fakeAMQP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeAMQP{listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c := &fakeAMQPConn{server: s, conn: conn, channels: map[uint16]*fakeAMQPChannel{}}
+			s.mu.Lock()
+			s.conns = append(s.conns, c)
+			s.mu.Unlock()
+			go c.serve()
+		}
+	}()
+	return s
+}
+
+func (s *fakeAMQP) URL() string {
+	return "amqp://guest:guest@" + s.listener.Addr().String() + "/"
+}
+
+func (s *fakeAMQP) Close() {
+	s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.conn.Close()
+	}
+}
+
+func (s *fakeAMQP) publish(body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue = append(s.queue, fakeAMQPMessage{props: []byte{0, 0}, body: []byte(body)})
+}
+
+func (s *fakeAMQP) counts() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unacked := 0
+	for _, c := range s.conns {
+		for _, ch := range c.channels {
+			unacked += len(ch.unacked)
+		}
+	}
+	return len(s.queue), unacked
+}
+
+// closeChannels closes every channel from the server, as a broker does
+// after a channel error
+func (s *fakeAMQP) closeChannels() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		for id, ch := range c.channels {
+			s.requeue(ch)
+			delete(c.channels, id)
+			c.method(id, 20, 40, u16(406), shortstr("PRECONDITION_FAILED - test"), u16(0), u16(0))
+		}
+	}
+}
+
+// requeue puts back the unacked messages of a channel, with s.mu held
+func (s *fakeAMQP) requeue(ch *fakeAMQPChannel) {
+	for _, m := range ch.unacked {
+		m.redelivered = true
+		s.queue = append([]fakeAMQPMessage{m}, s.queue...)
+	}
+	ch.unacked = map[uint64]fakeAMQPMessage{}
+}
+
+func (c *fakeAMQPConn) serve() {
+	defer c.conn.Close()
+	r := bufio.NewReader(c.conn)
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return
+	}
+	c.method(0, 10, 10, []byte{0, 9}, u32(0), longstr("PLAIN"), longstr("en_US"))
+	for {
+		typ, channel, payload, err := readAMQPFrame(r)
+		if err != nil {
+			return
+		}
+		if !c.handle(typ, channel, payload) {
+			return
+		}
+	}
+}
+
+func (c *fakeAMQPConn) handle(typ byte, channel uint16, payload []byte) bool {
+	s := c.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch := c.channels[channel]
+	switch typ {
+	case 2:
+		if ch != nil && ch.incoming != nil {
+			ch.size = binary.BigEndian.Uint64(payload[4:12])
+			ch.incoming.props = append([]byte{}, payload[12:]...)
+			c.published(ch)
+		}
+		return true
+	case 3:
+		if ch != nil && ch.incoming != nil {
+			ch.incoming.body = append(ch.incoming.body, payload...)
+			c.published(ch)
+		}
+		return true
+	case 1:
+	default:
+		return true
+	}
+	class, method, args := binary.BigEndian.Uint16(payload), binary.BigEndian.Uint16(payload[2:]), payload[4:]
+	switch {
+	case class == 10 && method == 11:
+		c.method(0, 10, 30, u16(0), u32(131072), u16(0))
+	case class == 10 && method == 40:
+		c.method(0, 10, 41, shortstr(""))
+	case class == 10 && method == 50:
+		for _, ch := range c.channels {
+			s.requeue(ch)
+		}
+		c.channels = map[uint16]*fakeAMQPChannel{}
+		c.method(0, 10, 51)
+		return false
+	case class == 20 && method == 10:
+		c.channels[channel] = &fakeAMQPChannel{unacked: map[uint64]fakeAMQPMessage{}}
+		c.method(channel, 20, 11, longstr(""))
+	case class == 20 && method == 40:
+		if ch != nil {
+			s.requeue(ch)
+		}
+		delete(c.channels, channel)
+		c.method(channel, 20, 41)
+	case class == 85 && method == 10:
+		ch.confirm = true
+		c.method(channel, 85, 11)
+	case class == 50 && method == 10:
+		name := string(args[3 : 3+args[2]])
+		s.declared = append([]byte{}, args[3+len(name)+1:]...)
+		c.method(channel, 50, 11, shortstr(name), u32(uint32(len(s.queue))), u32(0))
+	case class == 60 && method == 70:
+		if len(s.queue) == 0 {
+			c.method(channel, 60, 72, shortstr(""))
+			break
+		}
+		m := s.queue[0]
+		s.queue = s.queue[1:]
+		ch.tag++
+		ch.unacked[ch.tag] = m
+		redelivered := byte(0)
+		if m.redelivered {
+			redelivered = 1
+		}
+		c.method(channel, 60, 71, u64(ch.tag), []byte{redelivered}, shortstr(""), shortstr("jobs"), u32(uint32(len(s.queue))))
+		c.frame(2, channel, append(append(u16(60), u16(0)...), append(u64(uint64(len(m.body))), m.props...)...))
+		if len(m.body) > 0 {
+			c.frame(3, channel, m.body)
+		}
+	case class == 60 && method == 80:
+		delete(ch.unacked, binary.BigEndian.Uint64(args))
+	case class == 60 && (method == 120 || method == 90):
+		tag := binary.BigEndian.Uint64(args)
+		m := ch.unacked[tag]
+		delete(ch.unacked, tag)
+		requeue := args[8]&1 == 1
+		if method == 120 {
+			requeue = args[8]&2 == 2
+		}
+		if requeue {
+			m.redelivered = true
+			s.queue = append([]fakeAMQPMessage{m}, s.queue...)
+		} else {
+			s.rejected = append(s.rejected, m.body)
+		}
+	case class == 60 && method == 40:
+		ch.incoming = &fakeAMQPMessage{}
+	}
+	return true
+}
+
+// published queues the incoming message of a channel once its body is
+// complete, and confirms it
+func (c *fakeAMQPConn) published(ch *fakeAMQPChannel) {
+	if uint64(len(ch.incoming.body)) < ch.size {
+		return
+	}
+	c.server.queue = append(c.server.queue, *ch.incoming)
+	ch.incoming = nil
+	if ch.confirm {
+		ch.seq++
+		for id, other := range c.channels {
+			if other == ch {
+				c.method(id, 60, 80, u64(ch.seq), []byte{0})
+			}
+		}
+	}
+}
+
+func (c *fakeAMQPConn) method(channel, class, method uint16, args ...[]byte) {
+	payload := append(u16(class), u16(method)...)
+	for _, arg := range args {
+		payload = append(payload, arg...)
+	}
+	c.frame(1, channel, payload)
+}
+
+func (c *fakeAMQPConn) frame(typ byte, channel uint16, payload []byte) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	frame := append([]byte{typ}, u16(channel)...)
+	frame = append(frame, u32(uint32(len(payload)))...)
+	frame = append(frame, payload...)
+	c.conn.Write(append(frame, 0xce))
+}
+
+func readAMQPFrame(r *bufio.Reader) (byte, uint16, []byte, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[3:])+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	return header[0], binary.BigEndian.Uint16(header[1:]), payload[:len(payload)-1], nil
+}
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func shortstr(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func longstr(s string) []byte {
+	return append(u32(uint32(len(s))), s...)
+}
+
+func TestAMQPBroker(t *testing.T) {
+	server := newFakeAMQP(t)
+	defer server.Close()
+	b, err := newAMQPBroker(server.URL(), "jobs", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	server.mu.Lock()
+	declared := server.declared
+	server.mu.Unlock()
+	if !bytes.Contains(declared, append([]byte("\x12x-consumer-timeoutl"), u64(3600000)...)) {
+		t.Errorf("expected the queue to be declared with x-consumer-timeout, got: %q", declared)
+	}
+	server.publish(`{"evidencePath": "/data/a.E01"}`)
+
+	// requeued messages count their attempts past the redelivered flag of
+	// classic queues
+	for attempt := 1; attempt <= 3; attempt++ {
+		msg, ok, err := b.Get()
+		if err != nil || !ok {
+			t.Fatalf("expected a message, got: %v %v", ok, err)
+		}
+		if msg.Attempt != attempt || string(msg.Body) != `{"evidencePath": "/data/a.E01"}` {
+			t.Fatalf("expected attempt %d, got: %d %s", attempt, msg.Attempt, msg.Body)
+		}
+		if attempt < 3 {
+			err = msg.Requeue(attempt + 1)
+		} else {
+			err = msg.Ack()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// acks have no answer, the server takes them in its own time
+	ready, unacked := server.counts()
+	for i := 0; i < 100 && unacked != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		ready, unacked = server.counts()
+	}
+	if ready != 0 || unacked != 0 {
+		t.Errorf("expected the message to be acked, got: %d ready, %d unacked", ready, unacked)
+	}
+
+	// the channel is reopened after the broker closes it, and its unacked
+	// delivery comes back as another attempt
+	server.publish(`{"evidencePath": "/data/b.E01"}`)
+	msg, _, err := b.Get()
+	if err != nil || msg.Attempt != 1 {
+		t.Fatalf("expected a first attempt, got: %d %v", msg.Attempt, err)
+	}
+	server.closeChannels()
+	select {
+	case <-msg.Lost:
+	case <-time.After(time.Second):
+		t.Fatal("expected the delivery of the closed channel to be lost")
+	}
+	if err := msg.Ack(); err == nil {
+		t.Error("expected a delivery of a closed channel not to be acked")
+	}
+	if err := msg.Requeue(2); err == nil {
+		t.Error("expected a delivery of a closed channel not to be requeued")
+	}
+	msg, ok, err := b.Get()
+	if err != nil || !ok || msg.Attempt != 2 {
+		t.Fatalf("expected the redelivered message, got: %v %d %v", ok, msg.Attempt, err)
+	}
+	if err := msg.Reject(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := b.Get(); ok || err != nil {
+		t.Errorf("expected an empty queue, got: %v %v", ok, err)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.rejected) != 1 || string(server.rejected[0]) != `{"evidencePath": "/data/b.E01"}` {
+		t.Errorf("expected the message to be rejected, got: %q", server.rejected)
+	}
+}
+
+// TestAMQPBrokerServer runs against the broker at AMQP_TEST_URL, e.g. a
+// RabbitMQ container
+func TestAMQPBrokerServer(t *testing.T) {
+	URL := os.Getenv("AMQP_TEST_URL")
+	if URL == "" {
+		t.Skip("AMQP_TEST_URL not set")
+	}
+	queue := "ipedworker.test." + newJobID()
+	b, err := newAMQPBroker(URL, queue, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	defer b.channel.QueueDelete(queue, false, false, false)
+	err = b.channel.Publish("", queue, false, false, amqp.Publishing{Body: []byte(`{"evidencePath": "/data/a.E01"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for attempt := 1; attempt <= 3; attempt++ {
+		var msg brokerMessage
+		var ok bool
+		for i := 0; i < 100 && !ok; i++ {
+			msg, ok, err = b.Get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		if !ok || msg.Attempt != attempt {
+			t.Fatalf("expected attempt %d, got: %v %d", attempt, ok, msg.Attempt)
+		}
+		if attempt < 3 {
+			err = msg.Requeue(attempt + 1)
+		} else {
+			err = msg.Reject()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// bus mirrors every event sent by the worker to in-process subscribers
+var bus = newEventBus()
+
+// busMessage is an event with its sequence number on the bus
+type busMessage struct {
+	Seq   uint64
+	Event event
+}
+
+// eventBus fans out events to subscribers. Subscribers that do not keep up
+// lose events instead of blocking the publisher.
+type eventBus struct {
+	mu   sync.Mutex
+	seq  uint64
+	subs map[chan busMessage]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subs: map[chan busMessage]struct{}{},
+	}
+}
+
+func (b *eventBus) publish(ev event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	msg := busMessage{Seq: b.seq, Event: ev}
+	for sub := range b.subs {
+		select {
+		case sub <- msg:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel with the events published from now on and a
+// function to unsubscribe
+func (b *eventBus) subscribe() (<-chan busMessage, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sub := make(chan busMessage, 256)
+	b.subs[sub] = struct{}{}
+	return sub, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs, sub)
+	}
+}
+
+// eventStream streams the bus as Server-Sent Events
+func eventStream(b *eventBus) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		sub, unsubscribe := b.subscribe()
+		defer unsubscribe()
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case msg := <-sub:
+				j, err := json.Marshal(msg.Event)
+				if err != nil {
+					continue
+				}
+				_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", msg.Seq, msg.Event.Type, j)
+				if err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	}
+}
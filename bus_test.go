@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEventBus(t *testing.T) {
+	lockService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer lockService.Close()
+	sub, unsubscribe := bus.subscribe()
+	defer unsubscribe()
+
+	locker := remoteLocker{URL: lockService.URL}
+	if err := locker.Lock(context.Background(), "/data/image.E01"); err != nil {
+		t.Fatal(err)
+	}
+	if err := locker.Unlock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{"LOCK", "UNLOCK"}
+	var last uint64
+	for _, typ := range expect {
+		msg := <-sub
+		if msg.Event.Type != typ || msg.Event.Payload.EvidencePath != "/data/image.E01" {
+			t.Errorf("expected: %s event, got: %+v", typ, msg.Event)
+		}
+		if msg.Seq <= last {
+			t.Errorf("expected increasing sequence, got: %v after %v", msg.Seq, last)
+		}
+		last = msg.Seq
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	b := newEventBus()
+	srv := httptest.NewServer(http.HandlerFunc(eventStream(b)))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("unexpected content type: %v", ct)
+	}
+	b.publish(event{Type: "running", Payload: eventPayload{EvidencePath: "/data/image.E01"}})
+
+	reader := bufio.NewReader(resp.Body)
+	lines := []string{}
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimSpace(line))
+	}
+	expect := []string{
+		"id: 1",
+		"event: running",
+		`data: {"type":"running","payload":{"evidencePath":"/data/image.E01"}}`,
+	}
+	for i := range expect {
+		if lines[i] != expect[i] {
+			t.Errorf("expected: %q, got: %q", expect[i], lines[i])
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// setting is a worker setting: its key in the config file, its environment
+// variable and its flag
+type setting struct {
+	key  string
+	env  string
+	flag string
+	// sep joins the items of a list in the config file
+	sep   string
+	check func(string) error
+}
+
+func checkInt(s string) error {
+	_, err := strconv.Atoi(s)
+	return err
+}
+
+func checkFloat(s string) error {
+	_, err := strconv.ParseFloat(s, 64)
+	return err
+}
+
+func checkBool(s string) error {
+	_, err := strconv.ParseBool(s)
+	return err
+}
+
+func checkDuration(s string) error {
+	_, err := time.ParseDuration(s)
+	return err
+}
+
+func checkBytes(s string) error {
+	_, err := parseBytes(s)
+	return err
+}
+
+func checkMemory(s string) error {
+	_, err := parseMemory(s)
+	return err
+}
+
+func checkMode(s string) error {
+	_, err := parseOctalMode(s)
+	return err
+}
+
+func checkOwner(s string) error {
+	_, _, err := parseOwner(s)
+	return err
+}
+
+func checkIDRanges(s string) error {
+	_, err := parseIDRanges(s)
+	return err
+}
+
+// settings are the settings that can be in the config file, grouped by the
+// first part of their key
+var settings = []setting{
+	{key: "worker.port", env: "PORT", flag: "port", check: checkInt},
+	{key: "worker.slots", env: "WORKER_SLOTS", flag: "slots", check: checkInt},
+	{key: "worker.cpus", env: "WORKER_CPUS", flag: "cpus", check: checkFloat},
+	{key: "worker.memory", env: "WORKER_MEMORY", flag: "memory", check: checkMemory},
+	{key: "worker.liveness", env: "LIVENESS_THRESHOLD", flag: "liveness", check: checkDuration},
+
+	{key: "job.id", env: "JOB_ID", flag: "id"},
+	{key: "job.evidencePath", env: "EVIDENCE_PATH", flag: "path"},
+	{key: "job.outputPath", env: "OUTPUT_PATH", flag: "output"},
+	{key: "job.profile", env: "IPED_PROFILE", flag: "profile"},
+	{key: "job.additionalArgs", env: "ADD_ARGS", flag: "addargs", sep: " "},
+	{key: "job.additionalPaths", env: "ADD_PATHS", flag: "addpaths", sep: "\n"},
+	{key: "job.discoverRoot", env: "DISCOVER_ROOT", flag: "discover"},
+	{key: "job.traceParent", env: "TRACEPARENT", flag: "traceparent"},
+
+	{key: "notifier.url", env: "NOTIFY_URL", flag: "notifier"},
+	{key: "locker.url", env: "LOCK_URL", flag: "lock"},
+
+	{key: "jvm.jar", env: "IPEDJAR", flag: "jar"},
+	{key: "jvm.cpus", env: "JOB_CPUS", flag: "jobcpus", check: checkFloat},
+	{key: "jvm.memory", env: "JOB_MEMORY", flag: "jobmemory", check: checkMemory},
+
+	{key: "permissions.rules", env: "PERM_RULES", flag: "permrules", sep: "\n", check: func(s string) error {
+		_, err := parsePermRules(s)
+		return err
+	}},
+	{key: "permissions.owner", env: "PERM_OWNER", flag: "permowner", check: checkOwner},
+	{key: "permissions.acl", env: "PERM_ACL", flag: "permacl", sep: ",", check: func(s string) error {
+		_, err := parseACL(s)
+		return err
+	}},
+	{key: "permissions.runningMode", env: "PERM_RUNNING_MODE", flag: "permrunning", check: checkMode},
+	{key: "permissions.doneMode", env: "PERM_DONE_MODE", flag: "permdone", check: checkMode},
+
+	{key: "runAs.user", env: "RUN_AS", flag: "runas", check: checkOwner},
+	{key: "runAs.groups", env: "RUN_AS_GROUPS", flag: "runasgroups", sep: ",", check: func(s string) error {
+		_, err := parseGroups(s)
+		return err
+	}},
+	{key: "runAs.jobUIDs", env: "RUN_AS_JOB_UIDS", flag: "runasjobuids", sep: ",", check: checkIDRanges},
+	{key: "runAs.jobGIDs", env: "RUN_AS_JOB_GIDS", flag: "runasjobgids", sep: ",", check: checkIDRanges},
+	{key: "runAs.shareOwner", env: "RUN_AS_SHARE_OWNER", flag: "runasshare", check: checkBool},
+	{key: "runAs.umask", env: "RUN_UMASK", flag: "umask", check: func(s string) error {
+		_, err := parseUmask(s)
+		return err
+	}},
+
+	{key: "move.path", env: "MV_PATH", flag: "mvpath"},
+
+	{key: "source.type", env: "JOB_SOURCE", flag: "source"},
+	{key: "source.aging", env: "JOB_AGING", flag: "aging", check: checkDuration},
+	{key: "spool.dir", env: "SPOOL_DIR", flag: "spool"},
+	{key: "spool.interval", env: "SPOOL_INTERVAL", flag: "spoolinterval", check: checkDuration},
+	{key: "spool.lease", env: "SPOOL_LEASE", flag: "spoollease", check: checkDuration},
+	{key: "watch.dirs", env: "WATCH_DIRS", flag: "watch", sep: ","},
+	{key: "watch.quiet", env: "WATCH_QUIET", flag: "watchquiet", check: checkDuration},
+	{key: "watch.interval", env: "WATCH_INTERVAL", flag: "watchinterval", check: checkDuration},
+	{key: "amqp.url", env: "AMQP_URL", flag: "amqp"},
+	{key: "amqp.queue", env: "AMQP_QUEUE", flag: "amqpqueue"},
+	{key: "amqp.interval", env: "BROKER_INTERVAL", flag: "brokerinterval", check: checkDuration},
+	{key: "amqp.consumerTimeout", env: "BROKER_CONSUMER_TIMEOUT", flag: "consumertimeout", check: checkDuration},
+
+	{key: "retry.delay", env: "JOB_RETRY_DELAY", flag: "retrydelay", check: checkDuration},
+	{key: "retry.maxAttempts", env: "JOB_MAX_ATTEMPTS", flag: "maxattempts", check: checkInt},
+
+	{key: "metrics.labels", env: "METRIC_LABELS", flag: "metriclabels", sep: ",", check: func(s string) error {
+		_, err := parseMetricLabels(s)
+		return err
+	}},
+	{key: "metrics.retention", env: "METRICS_RETENTION", flag: "metricsretention", check: checkDuration},
+	{key: "metrics.pushURL", env: "PUSHGATEWAY_URL", flag: "push"},
+	{key: "metrics.pushInterval", env: "PUSH_INTERVAL", flag: "pushinterval", check: checkDuration},
+	{key: "metrics.pushJob", env: "PUSH_JOB", flag: "pushjob"},
+
+	{key: "tracing.endpoint", env: "OTEL_EXPORTER_OTLP_ENDPOINT", flag: "otlp"},
+	{key: "tracing.exporter", env: "OTEL_TRACES_EXPORTER", flag: "traces"},
+	{key: "tracing.file", env: "TRACES_FILE", flag: "tracesfile"},
+	{key: "tracing.serviceName", env: "OTEL_SERVICE_NAME", flag: "servicename"},
+
+	{key: "logging.format", env: "LOG_FORMAT", flag: "logformat"},
+	{key: "logging.level", env: "LOG_LEVEL", flag: "loglevel", check: func(s string) error {
+		_, err := parseLogLevel(s)
+		return err
+	}},
+	{key: "logging.maxSize", env: "LOG_MAX_SIZE", flag: "logmaxsize", check: checkBytes},
+	{key: "logging.maxAge", env: "LOG_MAX_AGE", flag: "logmaxage", check: checkDuration},
+}
+
+// fileConfig has the values of the config file by environment variable,
+// they come after the environment
+var fileConfig = map[string]string{}
+
+// lookupSetting reads a setting from the environment or the config file
+func lookupSetting(env string) (string, bool) {
+	if v, ok := os.LookupEnv(env); ok {
+		return v, true
+	}
+	v, ok := fileConfig[env]
+	return v, ok
+}
+
+// getSetting is like os.Getenv, with the config file after the environment
+func getSetting(env string) string {
+	v, _ := lookupSetting(env)
+	return v
+}
+
+// configPath finds the config file in the arguments, before they are parsed
+// as the other flags default to its values, or in CONFIG_FILE
+func configPath(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		if strings.HasPrefix(name, "config=") {
+			return strings.TrimPrefix(name, "config=")
+		}
+		if name == "config" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return os.Getenv("CONFIG_FILE")
+}
+
+// parseConfig reads a YAML config file into values by environment variable.
+// Problems are unknown keys and invalid values, with their lines.
+func parseConfig(data []byte) (map[string]string, []string, error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	values := map[string]string{}
+	problems := []string{}
+	if len(doc.Content) == 0 {
+		return values, problems, nil
+	}
+	byKey := map[string]setting{}
+	for _, s := range settings {
+		byKey[s.key] = s
+	}
+	var walk func(prefix string, node *yaml.Node)
+	walk = func(prefix string, node *yaml.Node) {
+		if node.Kind != yaml.MappingNode {
+			problems = append(problems, fmt.Sprintf("line %d: expected a mapping", node.Line))
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyNode, value := node.Content[i], node.Content[i+1]
+			key := prefix + keyNode.Value
+			s, known := byKey[key]
+			if value.Kind == yaml.MappingNode && !known {
+				walk(key+".", value)
+				continue
+			}
+			if !known {
+				problems = append(problems, fmt.Sprintf("line %d: unknown key %s", keyNode.Line, key))
+				continue
+			}
+			var v string
+			switch value.Kind {
+			case yaml.ScalarNode:
+				v = value.Value
+			case yaml.SequenceNode:
+				if s.sep == "" {
+					problems = append(problems, fmt.Sprintf("line %d: %s is not a list", value.Line, key))
+					continue
+				}
+				items := []string{}
+				for _, item := range value.Content {
+					items = append(items, item.Value)
+				}
+				v = strings.Join(items, s.sep)
+			default:
+				problems = append(problems, fmt.Sprintf("line %d: invalid %s", value.Line, key))
+				continue
+			}
+			if s.check != nil && v != "" {
+				if err := s.check(v); err != nil {
+					problems = append(problems, fmt.Sprintf("line %d: invalid %s: %v", value.Line, key, err))
+					continue
+				}
+			}
+			values[s.env] = v
+		}
+	}
+	walk("", doc.Content[0])
+	return values, problems, nil
+}
+
+func readConfig(path string) (map[string]string, []string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return parseConfig(data)
+}
+
+// configCommand implements `worker config validate <file>...`
+func configCommand(args []string, w io.Writer) int {
+	if len(args) < 2 || args[0] != "validate" {
+		fmt.Fprintln(w, "usage: worker config validate <file>...")
+		return 2
+	}
+	code := 0
+	for _, path := range args[1:] {
+		values, problems, err := readConfig(path)
+		if err != nil {
+			fmt.Fprintf(w, "%s: FAILED: %v\n", path, err)
+			code = 1
+			continue
+		}
+		for _, problem := range problems {
+			fmt.Fprintf(w, "%s: %s\n", path, problem)
+		}
+		if len(problems) > 0 {
+			fmt.Fprintf(w, "%s: FAILED, %d problems\n", path, len(problems))
+			code = 1
+			continue
+		}
+		fmt.Fprintf(w, "%s: OK, %d settings\n", path, len(values))
+	}
+	return code
+}
+
+// configEntry is a setting in GET /config
+type configEntry struct {
+	Key   string `json:"key"`
+	Env   string `json:"env"`
+	Flag  string `json:"flag"`
+	Value string `json:"value"`
+	// Source is flag, env, file or default
+	Source string `json:"source"`
+}
+
+// secretName matches the names of settings and URL query parameters that
+// hold secrets
+var secretName = regexp.MustCompile(`(?i)(password|passwd|secret|token|api_?key|credential|auth)`)
+
+// redact hides the value of a secret-like setting, and the passwords and
+// secret query parameters, like ?token= or ?access_token=, of URLs
+func redact(name, v string) string {
+	if v == "" {
+		return v
+	}
+	if secretName.MatchString(name) {
+		return "xxxxx"
+	}
+	u, err := url.Parse(v)
+	if err != nil {
+		return v
+	}
+	changed := false
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+		changed = true
+	}
+	query := u.Query()
+	for key := range query {
+		if secretName.MatchString(key) {
+			query.Set(key, "xxxxx")
+			changed = true
+		}
+	}
+	if !changed {
+		return v
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// effectiveConfig lists the value of each setting after parsing fs, and
+// where it came from
+func effectiveConfig(fs *flag.FlagSet) []configEntry {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	entries := []configEntry{}
+	for _, s := range settings {
+		f := fs.Lookup(s.flag)
+		if f == nil {
+			continue
+		}
+		entry := configEntry{Key: s.key, Env: s.env, Flag: s.flag, Value: redact(s.env, f.Value.String()), Source: "default"}
+		if _, ok := os.LookupEnv(s.env); set[s.flag] {
+			entry.Source = "flag"
+		} else if ok {
+			entry.Source = "env"
+		} else if _, ok := fileConfig[s.env]; ok {
+			entry.Source = "file"
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].Key < entries[b].Key })
+	return entries
+}
+
+func configHandler(fs *flag.FlagSet) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(effectiveConfig(fs))
+	}
+}
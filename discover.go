@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// evidenceKinds maps the extensions of the images IPED opens to their kind.
+// Only the first segment of split images is listed, the others are found by
+// splitSegments.
+var evidenceKinds = map[string]string{
+	".e01":  "ewf",
+	".ex01": "ewf",
+	".l01":  "ewf",
+	".lx01": "ewf",
+	".001":  "raw",
+	".0001": "raw",
+	".dd":   "raw",
+	".raw":  "raw",
+	".img":  "raw",
+	".ad1":  "ad1",
+	".ufdr": "ufdr",
+	".iso":  "iso",
+	".vmdk": "vmdk",
+	".vhd":  "vhd",
+	".vhdx": "vhd",
+}
+
+// vmdkExtent matches the data files of split and flat VMDKs, IPED opens
+// their descriptor
+var vmdkExtent = regexp.MustCompile(`(?i)-(flat|s[0-9]{3}|f[0-9]{3})\.vmdk$`)
+
+// ipedOutputMarkers are files of a folder created by IPED
+var ipedOutputMarkers = []string{"IPED-SearchApp.exe", "indexador", logName}
+
+// evidence is an evidence found by discoverEvidence. Files next to images
+// that are not part of one have the kind "loose", they are reported but not
+// processed.
+type evidence struct {
+	Path     string   `json:"path"`
+	Kind     string   `json:"kind"`
+	Segments []string `json:"segments,omitempty"`
+	Size     int64    `json:"size"`
+}
+
+// isIpedOutput tells whether dir is a case folder created by IPED
+func isIpedOutput(dir string) bool {
+	for _, marker := range ipedOutputMarkers {
+		if _, err := os.Stat(filepath.Join(dir, marker)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// discoverEvidence finds the evidence under root: the images of any folder
+// and, as folder evidence, the folders right below root without images.
+// If root has neither, but has files, root itself is folder evidence. IPED
+// case folders are skipped. The other files of the folders with images come
+// last, as loose files.
+func discoverEvidence(root string) ([]evidence, error) {
+	root = filepath.Clean(root)
+	found := []evidence{}
+	withImages := map[string]bool{}
+	// others are the files that are not an image, imageParts the segments
+	// and extents of images
+	others := []evidence{}
+	imageParts := map[string]bool{}
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if p != root && isIpedOutput(p) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		kind, ok := evidenceKinds[strings.ToLower(filepath.Ext(p))]
+		if !ok || (kind == "vmdk" && vmdkExtent.MatchString(p)) {
+			others = append(others, evidence{Path: p, Kind: "loose", Size: info.Size()})
+			if ok {
+				imageParts[p] = true
+			}
+			return nil
+		}
+		segments, err := splitSegments(p)
+		if err != nil {
+			return err
+		}
+		ev := evidence{Path: p, Kind: kind}
+		if len(segments) > 1 {
+			ev.Segments = segments
+		}
+		for _, segment := range segments {
+			imageParts[segment] = true
+		}
+		ev.Size, err = pathSize(p)
+		if err != nil {
+			return err
+		}
+		found = append(found, ev)
+		imageParts[p] = true
+		for dir := filepath.Dir(p); ; dir = filepath.Dir(dir) {
+			rel, err := filepath.Rel(root, dir)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				break
+			}
+			withImages[dir] = true
+			if rel == "." {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	hasFiles := false
+	for _, entry := range entries {
+		p := filepath.Join(root, entry.Name())
+		if !entry.IsDir() {
+			hasFiles = hasFiles || entry.Mode().IsRegular()
+			continue
+		}
+		if withImages[p] || isIpedOutput(p) {
+			continue
+		}
+		size, err := folderSize(p)
+		if err != nil {
+			return nil, err
+		}
+		if size > 0 {
+			found = append(found, evidence{Path: p, Kind: "folder", Size: size})
+		}
+	}
+	if len(found) == 0 && hasFiles {
+		size, err := folderSize(root)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, evidence{Path: root, Kind: "folder", Size: size})
+	}
+	imageDirs := map[string]bool{}
+	for _, ev := range found {
+		if ev.Kind != "folder" {
+			imageDirs[filepath.Dir(ev.Path)] = true
+		}
+	}
+	for _, ev := range others {
+		if imageDirs[filepath.Dir(ev.Path)] && !imageParts[ev.Path] {
+			found = append(found, ev)
+		}
+	}
+	return found, nil
+}
+
+// folderSize is the size of the files below dir, out of IPED case folders
+func folderSize(dir string) (int64, error) {
+	size := int64(0)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && p != dir && isIpedOutput(p) {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// proposeJob makes a job of the evidence under root. The evidence closest to
+// root, the largest first, is the primary one, so the case folder is created
+// next to it. The others are additional paths, relative to the primary one
+// when they are below its folder. Loose files are returned after the
+// evidence of the job, out of it.
+func proposeJob(root string, defaults Job) (Job, []evidence, error) {
+	discovered, err := discoverEvidence(root)
+	if err != nil {
+		return Job{}, nil, err
+	}
+	found, loose := []evidence{}, []evidence{}
+	for _, ev := range discovered {
+		if ev.Kind == "loose" {
+			loose = append(loose, ev)
+		} else {
+			found = append(found, ev)
+		}
+	}
+	if len(found) == 0 {
+		return Job{}, nil, fmt.Errorf("no evidence found under %s", root)
+	}
+	depth := func(p string) int {
+		return strings.Count(p, string(filepath.Separator))
+	}
+	sort.SliceStable(found, func(a, b int) bool {
+		if da, db := depth(found[a].Path), depth(found[b].Path); da != db {
+			return da < db
+		}
+		if found[a].Size != found[b].Size {
+			return found[a].Size > found[b].Size
+		}
+		return found[a].Path < found[b].Path
+	})
+	job := defaults
+	job.EvidencePath = found[0].Path
+	dir := filepath.Dir(found[0].Path)
+	additional := []string{}
+	for _, ev := range found[1:] {
+		p := ev.Path
+		if rel, err := filepath.Rel(dir, p); err == nil && !strings.HasPrefix(rel, "..") {
+			p = rel
+		}
+		additional = append(additional, p)
+	}
+	job.AdditionalPaths = strings.Join(additional, "\n")
+	return job, append(found, loose...), nil
+}
+
+// discoverCommand implements `worker discover`, printing the job proposed
+// for each root or submitting it to a worker
+func discoverCommand(args []string, w io.Writer) int {
+	flags := flag.NewFlagSet("discover", flag.ContinueOnError)
+	flags.SetOutput(w)
+	submit := flags.String("submit", "", "URL of a worker accepting jobs, like http://worker/jobs, instead of printing the jobs")
+	output := flags.String("output", "SARD", "output path of the jobs")
+	profile := flags.String("profile", "", "IPED profile of the jobs")
+	if flags.Parse(args) != nil || flags.NArg() == 0 {
+		fmt.Fprintln(w, "usage: worker discover [-submit URL] [-output PATH] [-profile PROFILE] <root>...")
+		return 2
+	}
+	code := 0
+	for _, root := range flags.Args() {
+		job, found, err := proposeJob(root, Job{OutputPath: *output, Profile: *profile})
+		if err != nil {
+			fmt.Fprintf(w, "%s: %v\n", root, err)
+			code = 1
+			continue
+		}
+		if *submit == "" {
+			j, _ := json.MarshalIndent(struct {
+				Job      Job        `json:"job"`
+				Evidence []evidence `json:"evidence"`
+			}{job, found}, "", "  ")
+			fmt.Fprintln(w, string(j))
+			continue
+		}
+		j, _ := json.Marshal(job)
+		resp, err := http.Post(*submit, "application/json", bytes.NewReader(j))
+		if err != nil {
+			fmt.Fprintf(w, "%s: could not submit: %v\n", root, err)
+			code = 1
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			fmt.Fprintf(w, "%s: could not submit: %s %s\n", root, resp.Status, strings.TrimSpace(string(body)))
+			code = 1
+			continue
+		}
+		fmt.Fprintf(w, "%s: submitted %s\n", root, strings.TrimSpace(string(body)))
+	}
+	return code
+}
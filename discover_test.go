@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	for name, contents := range files {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDiscoverEvidence(t *testing.T) {
+	root, err := ioutil.TempDir("", "discover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	writeFiles(t, root, map[string]string{
+		"hd.E01":                        "0123456789",
+		"hd.E02":                        "0123456789",
+		"phone/extraction.ufdr":         "01234",
+		"usb/pen.001":                   "012",
+		"usb/pen.002":                   "012",
+		"usb/readme.txt":                "read me",
+		"vm/disk.vmdk":                  "descriptor",
+		"vm/disk-flat.vmdk":             "data",
+		"documents/report.docx":         "0123",
+		"documents/notes.txt":           "0123",
+		"notes.txt":                     "not evidence",
+		"SARD/IPED-SearchApp.exe":       "exe",
+		"SARD/indexador/lib/x.E01":      "0",
+		"empty/.keep":                   "",
+		"old/SARD/indexador/index.data": "0",
+	})
+
+	job, found, err := proposeJob(root, Job{OutputPath: "SARD", Profile: "forensic"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.EvidencePath != filepath.Join(root, "hd.E01") || job.Profile != "forensic" {
+		t.Errorf("expected the largest image at the root as primary, got: %+v", job)
+	}
+	// closest to the root, then largest first
+	expected := []string{"documents", "vm/disk.vmdk", "usb/pen.001", "phone/extraction.ufdr"}
+	got := strings.Split(job.AdditionalPaths, "\n")
+	if !equalStrings(got, expected) {
+		t.Errorf("expected additional paths %v, got: %v", expected, got)
+	}
+	kinds := map[string]string{}
+	for _, ev := range found {
+		kinds[filepath.Base(ev.Path)] = ev.Kind
+		if ev.Path == job.EvidencePath && (len(ev.Segments) != 2 || ev.Size != 20) {
+			t.Errorf("expected the segments of the image, got: %+v", ev)
+		}
+	}
+	if kinds["documents"] != "folder" || kinds["pen.001"] != "raw" || kinds["extraction.ufdr"] != "ufdr" {
+		t.Errorf("unexpected kinds: %v", kinds)
+	}
+	// files next to the images are reported last, out of the job
+	loose := []string{}
+	for _, ev := range found {
+		if ev.Kind == "loose" {
+			rel, _ := filepath.Rel(root, ev.Path)
+			loose = append(loose, rel)
+		}
+	}
+	if !equalStrings(loose, []string{"notes.txt", "usb/readme.txt"}) || found[len(found)-1].Kind != "loose" {
+		t.Errorf("expected the loose files next to the images, got: %v", loose)
+	}
+	if strings.Contains(job.AdditionalPaths, "notes.txt") || strings.Contains(job.AdditionalPaths, "readme.txt") {
+		t.Errorf("expected loose files out of the job, got: %s", job.AdditionalPaths)
+	}
+}
+
+func TestDiscoverRawSegments(t *testing.T) {
+	root, err := ioutil.TempDir("", "discover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	writeFiles(t, root, map[string]string{
+		"disk.0001": "0123",
+		"disk.0002": "0123",
+	})
+	found, err := discoverEvidence(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Kind != "raw" || len(found[0].Segments) != 2 || found[0].Size != 8 {
+		t.Errorf("expected one split raw image, got: %+v", found)
+	}
+}
+
+func TestDiscoverFolder(t *testing.T) {
+	root, err := ioutil.TempDir("", "discover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if _, _, err := proposeJob(root, Job{}); err == nil {
+		t.Error("expected an error without evidence")
+	}
+	writeFiles(t, root, map[string]string{"a.txt": "a", "b.pdf": "b"})
+	job, _, err := proposeJob(root, Job{})
+	if err != nil || job.EvidencePath != root || job.AdditionalPaths != "" {
+		t.Errorf("expected the root as folder evidence, got: %+v %v", job, err)
+	}
+
+	var out bytes.Buffer
+	if code := discoverCommand([]string{root}, &out); code != 0 || !strings.Contains(out.String(), `"kind": "folder"`) {
+		t.Errorf("expected the proposed job, got: %d %s", code, out.String())
+	}
+	if code := discoverCommand(nil, &out); code != 2 {
+		t.Errorf("expected usage, got: %d", code)
+	}
+}
+
+func TestDiscoverRelativeRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"case/hd.E01":         "0123456789",
+		"case/usb/pen.001":    "012",
+		"case/usb/readme.txt": "read me",
+		"case/docs/a.txt":     "a",
+	})
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, root := range []string{"./case", "case/", "case"} {
+		found, err := discoverEvidence(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kinds := map[string]string{}
+		for _, ev := range found {
+			kinds[filepath.ToSlash(ev.Path)] = ev.Kind
+		}
+		expected := map[string]string{
+			"case/hd.E01":         "ewf",
+			"case/usb/pen.001":    "raw",
+			"case/usb/readme.txt": "loose",
+			"case/docs":           "folder",
+		}
+		if len(kinds) != len(expected) {
+			t.Errorf("%q: expected %v, got: %v", root, expected, kinds)
+			continue
+		}
+		for p, kind := range expected {
+			if kinds[p] != kind {
+				t.Errorf("%q: expected %s to be %s, got: %v", root, p, kind, kinds)
+			}
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build linux
+// +build linux
+
+package main
+
+import "syscall"
+
+// diskFree is the space available to unprivileged users on the filesystem of p
+func diskFree(p string) (uint64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(p, &st)
+	if err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
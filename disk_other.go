@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+func diskFree(p string) (uint64, error) {
+	return 0, fmt.Errorf("disk usage is not supported on this platform")
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// jobPlan is what a job would run, reported by dry runs
+type jobPlan struct {
+	Valid            bool              `json:"valid"`
+	Error            string            `json:"error,omitempty"`
+	Job              Job               `json:"job"`
+	Command          string            `json:"command"`
+	Args             []string          `json:"args"`
+	Dir              string            `json:"dir"`
+	CaseFolder       string            `json:"caseFolder"`
+	CaseFolderExists bool              `json:"caseFolderExists"`
+	AdditionalPaths  []string          `json:"additionalPaths,omitempty"`
+	MaxHeap          string            `json:"maxHeap,omitempty"`
+	RunAs            string            `json:"runAs,omitempty"`
+	ProfileDir       string            `json:"profileDir,omitempty"`
+	ProfileOverrides map[string]string `json:"profileOverrides,omitempty"`
+	// ProfileConfig are the values of the configuration overwrite_profile.sh
+	// can override, as read from the files of the profile
+	ProfileConfig map[string]string `json:"profileConfig,omitempty"`
+}
+
+// overwriteProfile is the script the IPED image runs to apply the iped_*
+// variables to the config files, embedded so its lists are read, not copied
+//
+//go:embed overwrite_profile.sh
+var overwriteProfile string
+
+// profileConfigLists are the variable lists of overwrite_profile.sh, by the
+// config file it writes them to: LocalConfig.txt next to the jar, the others
+// in the folder of each profile
+var profileConfigLists = []struct {
+	list string
+	file string
+}{
+	{"VARS_LOCAL_CONFIG", "LocalConfig.txt"},
+	{"VARS_IPED_CONFIG", "IPEDConfig.txt"},
+	{"VARS_ADVANCED_CONFIG", "conf/AdvancedConfig.txt"},
+}
+
+// scriptVars are the variables of a list of overwrite_profile.sh, like
+// VARS_LOCAL_CONFIG="iped_locale ..."
+func scriptVars(script, list string) []string {
+	start := strings.Index(script, list+`="`)
+	if start < 0 {
+		return nil
+	}
+	vars := script[start+len(list)+2:]
+	if end := strings.Index(vars, `"`); end >= 0 {
+		vars = vars[:end]
+	}
+	return strings.Fields(vars)
+}
+
+// profileConfig returns the variables of environ overwrite_profile.sh
+// applied, and the values the IPED of jar has for them with profileDir, both
+// without the iped_ prefix
+func profileConfig(environ []string, jar, profileDir string) (map[string]string, map[string]string) {
+	env := map[string]string{}
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+	overrides, resolved := map[string]string{}, map[string]string{}
+	for i, l := range profileConfigLists {
+		file := path.Join(profileDir, l.file)
+		if i == 0 {
+			file = path.Join(path.Dir(jar), l.file)
+		}
+		for _, v := range scriptVars(overwriteProfile, l.list) {
+			key := strings.TrimPrefix(v, "iped_")
+			if value, ok := env[v]; ok && value != "" {
+				overrides[key] = value
+			}
+			if i > 0 && profileDir == "" {
+				continue
+			}
+			if value := configValue(file, key); value != "" {
+				resolved[key] = value
+			}
+		}
+	}
+	return overrides, resolved
+}
+
+// planJob validates a job and tells how it would run, without locking,
+// creating folders or starting IPED
+func planJob(job Job, opts workerOptions, scheduler *slotScheduler) jobPlan {
+	plan := jobPlan{Job: job, Command: "java"}
+	errs := []string{}
+	res, err := scheduler.resourcesFor(job)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	params := jobParams(job, opts, res)
+	err = validateParams(params)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	cred, err := resolveCredential(params.runAs, params.jobRunAs, params)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("invalid runAs: %v", err))
+	}
+	if cred.isSet() {
+		plan.RunAs = fmt.Sprintf("%d:%d", cred.UID, cred.GID)
+	}
+	plan.Args = makeArgs(params)
+	plan.Dir = path.Dir(params.evidence)
+	plan.CaseFolder = caseFolder(params)
+	_, err = os.Stat(plan.CaseFolder)
+	plan.CaseFolderExists = err == nil
+	for _, p := range additionalPaths(params) {
+		if !path.IsAbs(p) {
+			p = path.Join(plan.Dir, p)
+		}
+		plan.AdditionalPaths = append(plan.AdditionalPaths, p)
+	}
+	plan.MaxHeap = params.maxHeap
+	if params.profile != "" {
+		dir := path.Join(path.Dir(params.jar), "profiles", ipedLocale(params.jar, ""), params.profile)
+		if _, err := os.Stat(dir); err == nil {
+			plan.ProfileDir = dir
+		} else if matches, _ := globProfiles(params.jar); len(matches) > 0 {
+			errs = append(errs, fmt.Sprintf("invalid profile %q, valid profiles are %s", params.profile, strings.Join(matches, ", ")))
+		}
+	}
+	plan.ProfileOverrides, plan.ProfileConfig = profileConfig(os.Environ(), params.jar, plan.ProfileDir)
+	plan.Valid = len(errs) == 0
+	plan.Error = strings.Join(errs, "; ")
+	return plan
+}
+
+// globProfiles lists the profiles of the IPED of jar, for any locale
+func globProfiles(jar string) ([]string, error) {
+	dirs, err := filepath.Glob(path.Join(path.Dir(jar), "profiles", "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	profiles := []string{}
+	for _, dir := range dirs {
+		name := path.Base(dir)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+		if !seen[name] {
+			seen[name] = true
+			profiles = append(profiles, name)
+		}
+	}
+	sort.Strings(profiles)
+	return profiles, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlanJob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dryrun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"iped/iped.jar":                                     "",
+		"iped/LocalConfig.txt":                              "locale = en\n",
+		"iped/profiles/en/forensic/IPEDConfig.txt":          "enableOCR = true\n# enableCarving = true\n",
+		"iped/profiles/en/forensic/conf/AdvancedConfig.txt": "numImageReaders = 4\nunknownKey = 1\n",
+		"iped/profiles/en/fastmode/IPEDConfig.txt":          "",
+		"case/hd.E01":                                       "",
+		"case/phone.ufdr":                                   "",
+	})
+	opts := workerOptions{jar: filepath.Join(dir, "iped", "iped.jar"), runAs: credential{UID: -1, GID: -1, Umask: -1}}
+	scheduler := newSlotScheduler("", 1, jobResources{}, jobResources{})
+	os.Setenv("iped_locale", "en")
+	defer os.Unsetenv("iped_locale")
+	// not one of the variables overwrite_profile.sh applies
+	os.Setenv("iped_typo", "1")
+	defer os.Unsetenv("iped_typo")
+
+	plan := planJob(Job{
+		EvidencePath:    filepath.Join(dir, "case", "hd.E01"),
+		OutputPath:      "SARD",
+		Profile:         "forensic",
+		AdditionalPaths: "phone.ufdr",
+		AdditionalArgs:  "--append",
+		Memory:          "8G",
+	}, opts, scheduler)
+	if !plan.Valid {
+		t.Fatalf("expected a valid plan, got: %s", plan.Error)
+	}
+	args := strings.Join(plan.Args, " ")
+	if !strings.Contains(args, "-Xmx") || !strings.HasSuffix(args, "-profile forensic --append -d phone.ufdr") {
+		t.Errorf("unexpected args: %s", args)
+	}
+	if plan.Dir != filepath.Join(dir, "case") || plan.CaseFolder != filepath.Join(dir, "case", "SARD") || plan.CaseFolderExists {
+		t.Errorf("unexpected folders: %+v", plan)
+	}
+	if plan.ProfileDir != filepath.Join(dir, "iped", "profiles", "en", "forensic") || plan.ProfileOverrides["locale"] != "en" {
+		t.Errorf("unexpected profile: %s %v", plan.ProfileDir, plan.ProfileOverrides)
+	}
+	if len(plan.ProfileOverrides) != 1 {
+		t.Errorf("expected only the variables of overwrite_profile.sh, got: %v", plan.ProfileOverrides)
+	}
+	expected := map[string]string{"locale": "en", "enableOCR": "true", "numImageReaders": "4"}
+	if !reflect.DeepEqual(plan.ProfileConfig, expected) {
+		t.Errorf("expected the profile config: %v, got: %v", expected, plan.ProfileConfig)
+	}
+	if _, err := os.Stat(plan.CaseFolder); !os.IsNotExist(err) {
+		t.Error("expected the case folder not to be created")
+	}
+
+	plan = planJob(Job{EvidencePath: filepath.Join(dir, "case", "missing.E01"), OutputPath: "SARD", Profile: "blind"}, opts, scheduler)
+	if plan.Valid || !strings.Contains(plan.Error, "invalid evidence") || !strings.Contains(plan.Error, "valid profiles are fastmode, forensic") {
+		t.Errorf("expected an invalid plan, got: %s", plan.Error)
+	}
+}
+
+// the variables must be the ones of overwrite_profile.sh
+func TestProfileConfigVars(t *testing.T) {
+	script, err := ioutil.ReadFile("overwrite_profile.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every list the script applies has its config file, and every iped_*
+	// variable of the script is in a list
+	known := map[string]bool{}
+	for _, l := range profileConfigLists {
+		vars := scriptVars(string(script), l.list)
+		if len(vars) == 0 {
+			t.Errorf("%s not found", l.list)
+		}
+		for _, v := range vars {
+			known[v] = true
+		}
+	}
+	for _, m := range regexp.MustCompile(`for v in \$\{(\w+)\}`).FindAllStringSubmatch(string(script), -1) {
+		found := false
+		for _, l := range profileConfigLists {
+			found = found || l.list == m[1]
+		}
+		if !found {
+			t.Errorf("%s has no config file in profileConfigLists", m[1])
+		}
+	}
+	for _, v := range regexp.MustCompile(`\biped_\w+`).FindAllString(string(script), -1) {
+		if !known[v] {
+			t.Errorf("%s is not in a list of profileConfigLists", v)
+		}
+	}
+	if len(known) < 80 {
+		t.Errorf("expected the variables of the script, got: %d", len(known))
+	}
+}
+
+func TestDryRunSubmission(t *testing.T) {
+	s := newHTTPSource(Job{OutputPath: "SARD"}, time.Hour)
+	s.plan = func(job Job) jobPlan {
+		return jobPlan{Valid: job.OutputPath == "SARD", Job: job}
+	}
+	w := httptest.NewRecorder()
+	s.handler(w, httptest.NewRequest("POST", "/jobs?dryRun=true", strings.NewReader(`{"evidencePath": "/data/a.E01"}`)))
+	var plan jobPlan
+	json.NewDecoder(w.Body).Decode(&plan)
+	if w.Code != http.StatusOK || !plan.Valid || plan.Job.ID == "" {
+		t.Errorf("expected a valid plan, got: %d %+v", w.Code, plan)
+	}
+	if s.queued() != 0 {
+		t.Error("expected a dry run not to be queued")
+	}
+}
@@ -2,20 +2,38 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"time"
 )
 
+// notifierClient sends the events, a notifier that does not answer in time
+// fails the send instead of holding it
+var notifierClient = &http.Client{Timeout: 30 * time.Second}
+
 type event struct {
 	Type    string       `json:"type"`
 	Payload eventPayload `json:"payload"`
 }
 
 type eventPayload struct {
-	EvidencePath string `json:"evidencePath"`
-	Progress     string `json:"progress,omitempty"`
+	EvidencePath string         `json:"evidencePath"`
+	Progress     string         `json:"progress,omitempty"`
+	OutputPath   string         `json:"outputPath,omitempty"`
+	Phase        string         `json:"phase,omitempty"`
+	Stats        *progressStats `json:"stats,omitempty"`
+	Permissions  *permCounts    `json:"permissions,omitempty"`
+	// EvidenceBytes, OutputBytes and GBPerHour are sent when a job is done
+	EvidenceBytes int64   `json:"evidenceBytes,omitempty"`
+	OutputBytes   int64   `json:"outputBytes,omitempty"`
+	GBPerHour     float64 `json:"gbPerHour,omitempty"`
+	// AuditHead is the hash of the last record of the audit log of the case
+	AuditHead string `json:"auditHead,omitempty"`
 }
 
 type eventWriter struct {
@@ -23,6 +41,7 @@ type eventWriter struct {
 	EvidencePath string
 	Writer       io.Writer
 	events       chan event
+	done         <-chan struct{}
 }
 
 func (r eventWriter) Write(p []byte) (int, error) {
@@ -35,7 +54,10 @@ func (r eventWriter) Write(p []byte) (int, error) {
 		},
 	}
 	go func() {
-		r.events <- ev
+		select {
+		case r.events <- ev:
+		case <-r.done:
+		}
 	}()
 	return i, err
 }
@@ -60,20 +82,54 @@ func (r doubleWriter) Write(p []byte) (int, error) {
 	return i1, nil
 }
 
-func sendEvent(URL string, ev event) error {
-	fmt.Printf("event: %v\n", ev)
+// sendEvent posts ev to URL in a client span, with the W3C trace context of
+// ctx. Progress events have no span of their own. Without URL the event is
+// only logged and published on the bus.
+func sendEvent(ctx context.Context, URL string, ev event) (finalError error) {
+	level := slog.LevelInfo
+	if ev.Type == "progress" {
+		level = slog.LevelDebug
+	}
+	loggerFrom(ctx).Log(ctx, level, "event", "type", ev.Type, "payload", ev.Payload)
+	bus.publish(ev)
+	if URL == "" {
+		// no notifier or lock service, e.g. in spool mode
+		return nil
+	}
+	// progress events are too many for a span each, they carry the trace
+	// context of the job
+	var sp *span
+	if ev.Type != "progress" {
+		ctx, sp = startSpan(ctx, "POST "+ev.Type)
+		sp.kind = spanKindClient
+		sp.setAttribute("http.method", "POST")
+		sp.setAttribute("http.url", URL)
+		sp.setAttribute("event.type", ev.Type)
+		defer func() {
+			sp.finish(finalError)
+		}()
+	}
 	j, err := json.Marshal(ev)
 	if err != nil {
 		return err
 	}
-	resp, err := http.Post(URL, "application/json", bytes.NewBuffer(j))
+	req, err := http.NewRequest("POST", URL, bytes.NewBuffer(j))
 	if err != nil {
-		fmt.Println(err)
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	injectTraceContext(ctx, req.Header)
+	resp, err := notifierClient.Do(req)
+	if err != nil {
+		loggerFrom(ctx).Warn("could not send event", "type", ev.Type, "url", URL, "err", err)
 		return err
 	}
 	defer resp.Body.Close()
+	if sp != nil {
+		sp.setAttribute("http.status_code", strconv.Itoa(resp.StatusCode))
+	}
 	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("response from remote locker not ok: %s", resp.Status)
+		loggerFrom(ctx).Warn("could not send event", "type", ev.Type, "url", URL, "status", resp.Status)
 		return fmt.Errorf("response from remote locker not ok: %s", resp.Status)
 	}
 	return nil
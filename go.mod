@@ -1,9 +1,22 @@
 module github.com/iped-docker/worker-go
 
-go 1.12
+go 1.21
 
 require (
-	github.com/gorilla/context v1.1.1 // indirect
 	github.com/gorilla/mux v1.6.2
 	github.com/prometheus/client_golang v1.5.1
+	github.com/rabbitmq/amqp091-go v1.9.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/golang/protobuf v1.3.2 // indirect
+	github.com/gorilla/context v1.1.1 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.9.1 // indirect
+	github.com/prometheus/procfs v0.0.8 // indirect
+	golang.org/x/sys v0.0.0-20200122134326-e047566fdf82 // indirect
 )
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// heartbeatInterval is how often healthy components check in
+const heartbeatInterval = 10 * time.Second
+
+// liveness holds the heartbeats reported by /healthz
+var liveness = newHeartbeats(2 * time.Minute)
+
+// heartbeats records when each active component last checked in
+type heartbeats struct {
+	mu        sync.Mutex
+	last      map[string]time.Time
+	threshold time.Duration
+}
+
+func newHeartbeats(threshold time.Duration) *heartbeats {
+	return &heartbeats{
+		last:      map[string]time.Time{},
+		threshold: threshold,
+	}
+}
+
+func (h *heartbeats) setThreshold(threshold time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.threshold = threshold
+}
+
+// beat records that component is alive
+func (h *heartbeats) beat(component string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last[component] = time.Now()
+}
+
+// stop forgets a component that finished normally
+func (h *heartbeats) stop(component string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.last, component)
+}
+
+// stale lists the components that did not check in within the threshold
+func (h *heartbeats) stale() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stale := []string{}
+	for component, last := range h.last {
+		since := time.Since(last)
+		if since > h.threshold {
+			stale = append(stale, fmt.Sprintf("%s: last heartbeat %v ago", component, since.Round(time.Second)))
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+func (h *heartbeats) check() error {
+	stale := h.stale()
+	if len(stale) > 0 {
+		return fmt.Errorf("stale components:\n%s", strings.Join(stale, "\n"))
+	}
+	return nil
+}
+
+// watchProcess checks in for component while the process is alive and
+// neither a zombie nor stopped, until done is closed
+func watchProcess(component string, pid int, done <-chan struct{}) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	defer liveness.stop(component)
+	liveness.beat(component)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			state, err := procState(pid)
+			if err == nil && state != 'Z' && state != 'T' {
+				liveness.beat(component)
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeartbeats(t *testing.T) {
+	h := newHeartbeats(time.Minute)
+	h.beat("jobLoop")
+	h.beat("eventThrottle/job1")
+	if err := h.check(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	h.last["eventThrottle/job1"] = time.Now().Add(-2 * time.Minute)
+	err := h.check()
+	if err == nil || !strings.Contains(err.Error(), "eventThrottle/job1") {
+		t.Errorf("expected eventThrottle/job1 to be stale, got: %v", err)
+	}
+	if strings.Contains(err.Error(), "jobLoop") {
+		t.Errorf("expected jobLoop not to be stale, got: %v", err)
+	}
+	h.stop("eventThrottle/job1")
+	if err := h.check(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	liveness.beat("test/healthz")
+	defer liveness.stop("test/healthz")
+	rec := httptest.NewRecorder()
+	healthz(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected: %v, got: %v", http.StatusOK, rec.Code)
+	}
+
+	liveness.mu.Lock()
+	liveness.last["test/healthz"] = time.Now().Add(-time.Hour)
+	liveness.mu.Unlock()
+	rec = httptest.NewRecorder()
+	healthz(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "test/healthz") {
+		t.Errorf("expected failing healthz naming test/healthz, got: %v %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestProcState(t *testing.T) {
+	state, err := procState(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state == 'Z' || state == 'T' {
+		t.Errorf("unexpected state of the test process: %c", state)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logger is the worker logger, set up by main from LOG_FORMAT and LOG_LEVEL
+var logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+// newLogger creates a text or json logger writing records at level or above
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, valid formats are text, json", format)
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q, valid levels are debug, info, warn, error", s)
+}
+
+type loggerContextKey struct{}
+
+// withLogger returns a context carrying l, see loggerFrom
+func withLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, l)
+}
+
+// loggerFrom is the job logger of ctx, or the worker logger
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return logger
+}
+
+// jobLogger adds the job id, evidence and attempt to every record
+func jobLogger(params ipedParams) *slog.Logger {
+	return logger.With("job", params.id, "evidence", params.evidence, "attempt", params.attempt)
+}
+
+// ipedLevels map the IPED log levels to slog
+var ipedLevels = map[string]slog.Level{
+	"DEBUG": slog.LevelDebug,
+	"INFO":  slog.LevelInfo,
+	"MSG":   slog.LevelInfo,
+	"WARN":  slog.LevelWarn,
+	"ERROR": slog.LevelError,
+}
+
+// ipedLogWriter logs every line of IPED output as a source=iped record, at
+// the level IPED printed. Lines without a level keep the previous one.
+func ipedLogWriter(ctx context.Context, l *slog.Logger) io.Writer {
+	level := slog.LevelInfo
+	return &lineWriter{f: func(line string) {
+		if lvl, ok := ipedLevels[lineLevel([]byte(line))]; ok {
+			level = lvl
+		}
+		l.Log(ctx, level, line, "source", "iped")
+	}}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestIpedLogWriter(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := newLogger(&buf, "json", "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := logger
+	logger = l
+	defer func() { logger = saved }()
+
+	jl := jobLogger(ipedParams{id: "job1", evidence: "/data/image.E01", attempt: 2})
+	w := ipedLogWriter(context.Background(), jl)
+	w.Write([]byte("2020-01-01 10:00:00\t[INFO]\t[Main] starting\n"))
+	w.Write([]byte("2020-01-01 10:00:01\t[ERROR]\t[Worker] failed\n\tat iped.Worker.run\n"))
+
+	expected := []struct {
+		level string
+		msg   string
+	}{
+		{"INFO", "[Main] starting"},
+		{"ERROR", "[Worker] failed"},
+		{"ERROR", "at iped.Worker.run"},
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d records, got: %q", len(expected), lines)
+	}
+	for i, line := range lines {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record["level"] != expected[i].level || !strings.Contains(record["msg"].(string), expected[i].msg) {
+			t.Errorf("expected %s %q, got: %v", expected[i].level, expected[i].msg, record)
+		}
+		if record["source"] != "iped" || record["job"] != "job1" || record["evidence"] != "/data/image.E01" || record["attempt"] != 2.0 {
+			t.Errorf("expected the job context and source=iped, got: %v", record)
+		}
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := newLogger(&buf, "text", "warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Info("hidden")
+	l.Warn("shown")
+	if strings.Contains(buf.String(), "hidden") || !strings.Contains(buf.String(), "shown") {
+		t.Errorf("expected only warnings, got: %s", buf.String())
+	}
+	if _, err := newLogger(&buf, "xml", ""); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+	if _, err := newLogger(&buf, "", "verbose"); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// logRotation limits the size and age of IPED.log, 0 disables a limit
+type logRotation struct {
+	MaxSize int64
+	MaxAge  time.Duration
+}
+
+// logSegment is a rotated part of IPED.log
+type logSegment struct {
+	File    string    `json:"file"`
+	Attempt int       `json:"attempt"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	// Bytes is the uncompressed size
+	Bytes int64 `json:"bytes"`
+}
+
+// logIndex lists the rotated segments of IPED.log, oldest first, and the
+// attempt writing to the active file
+type logIndex struct {
+	Active        string       `json:"active"`
+	ActiveAttempt int          `json:"activeAttempt"`
+	ActiveStart   time.Time    `json:"activeStart"`
+	Segments      []logSegment `json:"segments"`
+}
+
+const (
+	logName      = "IPED.log"
+	logIndexName = "IPED.log.index.json"
+)
+
+// rotatingLog is IPED.log in a case folder. Every attempt starts a new
+// file, the previous one becomes a segment, and so does the active file once
+// it gets too big or too old. Segments are named after their attempt,
+// IPED.attempt2.001.log.gz, and gzipped in the background.
+type rotatingLog struct {
+	mu       sync.Mutex
+	dir      string
+	attempt  int
+	rotation logRotation
+	file     *os.File
+	size     int64
+	opened   time.Time
+	index    logIndex
+	compress sync.WaitGroup
+}
+
+// openRotatingLog opens IPED.log in dir for attempt
+func openRotatingLog(dir string, attempt int, rotation logRotation) (*rotatingLog, error) {
+	l := &rotatingLog{
+		dir:      dir,
+		attempt:  attempt,
+		rotation: rotation,
+		index:    logIndex{Active: logName},
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	j, err := ioutil.ReadFile(filepath.Join(dir, logIndexName))
+	if err == nil {
+		err = json.Unmarshal(j, &l.index)
+		if err != nil {
+			logger.Warn("ignoring invalid log index", "dir", dir, "err", err)
+			l.index = logIndex{Active: logName}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	info, err := os.Stat(l.path())
+	if err == nil && info.Size() > 0 {
+		// left by a previous attempt, or by a worker without rotation
+		l.size = info.Size()
+		err = l.rotateAs(l.index.ActiveAttempt, l.index.ActiveStart, info.ModTime())
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = l.open()
+		if err != nil {
+			return nil, err
+		}
+	}
+	l.index.ActiveAttempt = attempt
+	l.index.ActiveStart = l.opened
+	return l, l.writeIndex()
+}
+
+func (l *rotatingLog) path() string {
+	return filepath.Join(l.dir, logName)
+}
+
+func (l *rotatingLog) open() error {
+	f, err := os.OpenFile(l.path(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	l.file = f
+	l.size = 0
+	l.opened = time.Now()
+	return nil
+}
+
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size > 0 && l.due(len(p)) {
+		err := l.rotateAs(l.attempt, l.opened, time.Now())
+		if err != nil {
+			return 0, err
+		}
+		l.index.ActiveStart = l.opened
+		err = l.writeIndex()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// due tells if writing n bytes needs a new file
+func (l *rotatingLog) due(n int) bool {
+	if l.rotation.MaxSize > 0 && l.size+int64(n) > l.rotation.MaxSize {
+		return true
+	}
+	return l.rotation.MaxAge > 0 && time.Since(l.opened) >= l.rotation.MaxAge
+}
+
+// rotateAs moves the active file to a segment of attempt and opens a new one
+func (l *rotatingLog) rotateAs(attempt int, start, end time.Time) error {
+	if l.file != nil {
+		err := l.file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	seq := 1
+	for _, s := range l.index.Segments {
+		if s.Attempt == attempt {
+			seq++
+		}
+	}
+	name := fmt.Sprintf("IPED.attempt%d.%03d.log", attempt, seq)
+	err := os.Rename(l.path(), filepath.Join(l.dir, name))
+	if err != nil {
+		return err
+	}
+	l.index.Segments = append(l.index.Segments, logSegment{
+		File:    name + ".gz",
+		Attempt: attempt,
+		Start:   start,
+		End:     end,
+		Bytes:   l.size,
+	})
+	l.compress.Add(1)
+	go l.gzip(name)
+	return l.open()
+}
+
+// gzip compresses a segment, the index keeps the plain file if it fails
+func (l *rotatingLog) gzip(name string) {
+	defer l.compress.Done()
+	src := filepath.Join(l.dir, name)
+	err := gzipFile(src, src+".gz")
+	if err == nil {
+		err = os.Remove(src)
+		if err == nil {
+			return
+		}
+	}
+	logger.Warn("could not compress log segment", "file", src, "err", err)
+	os.Remove(src + ".gz")
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.index.Segments {
+		if l.index.Segments[i].File == name+".gz" {
+			l.index.Segments[i].File = name
+		}
+	}
+	l.writeIndex()
+}
+
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	zw := gzip.NewWriter(out)
+	zw.Name = filepath.Base(src)
+	zw.ModTime = time.Now()
+	_, err = io.Copy(zw, in)
+	if err != nil {
+		return err
+	}
+	err = zw.Close()
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// writeIndex replaces the index atomically
+func (l *rotatingLog) writeIndex() error {
+	j, err := json.MarshalIndent(l.index, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(l.dir, "."+logIndexName+".tmp")
+	err = ioutil.WriteFile(tmp, append(j, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(l.dir, logIndexName))
+}
+
+// Close closes the active file and waits for the segments to be compressed
+func (l *rotatingLog) Close() error {
+	l.mu.Lock()
+	err := l.file.Close()
+	l.mu.Unlock()
+	l.compress.Wait()
+	return err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readGzip(t *testing.T, p string) string {
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func readIndex(t *testing.T, dir string) logIndex {
+	j, err := ioutil.ReadFile(filepath.Join(dir, logIndexName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index logIndex
+	err = json.Unmarshal(j, &index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return index
+}
+
+func TestRotatingLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logrotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := openRotatingLog(dir, 1, logRotation{MaxSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Write([]byte("0123456\n"))
+	l.Write([]byte("abcdef\n"))
+	l.Write([]byte("ghi\n"))
+	l.Close()
+
+	if s := readGzip(t, filepath.Join(dir, "IPED.attempt1.001.log.gz")); s != "0123456\nabcdef\n" {
+		t.Errorf("unexpected first segment: %q", s)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "IPED.attempt1.001.log")); !os.IsNotExist(err) {
+		t.Errorf("expected the plain segment to be removed, got: %v", err)
+	}
+	active, _ := ioutil.ReadFile(filepath.Join(dir, logName))
+	if string(active) != "ghi\n" {
+		t.Errorf("unexpected active log: %q", active)
+	}
+
+	// a retry moves the log of the first attempt aside
+	l, err = openRotatingLog(dir, 2, logRotation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Write([]byte("retry\n"))
+	l.Close()
+
+	if s := readGzip(t, filepath.Join(dir, "IPED.attempt1.002.log.gz")); s != "ghi\n" {
+		t.Errorf("unexpected second segment: %q", s)
+	}
+	index := readIndex(t, dir)
+	if index.Active != logName || index.ActiveAttempt != 2 || len(index.Segments) != 2 {
+		t.Fatalf("unexpected index: %+v", index)
+	}
+	if index.Segments[1].File != "IPED.attempt1.002.log.gz" || index.Segments[1].Attempt != 1 || index.Segments[1].Bytes != 4 {
+		t.Errorf("unexpected segment: %+v", index.Segments[1])
+	}
+}
+
+func TestRotatingLogWithoutIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logrotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// left by a worker without rotation
+	ioutil.WriteFile(filepath.Join(dir, logName), []byte("old\n"), 0644)
+
+	l, err := openRotatingLog(dir, 1, logRotation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if s := readGzip(t, filepath.Join(dir, "IPED.attempt0.001.log.gz")); s != "old\n" {
+		t.Errorf("unexpected segment: %q", s)
+	}
+}
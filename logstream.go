@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// logLevels ranks the levels printed by IPED, like "[WARN]"
+var logLevels = map[string]int{
+	"DEBUG": 0,
+	"INFO":  1,
+	"MSG":   2,
+	"WARN":  3,
+	"ERROR": 4,
+}
+
+// lineLevel finds the IPED level of a log line, or "" for lines without one
+// (e.g. Java stack traces), which keep the level of the previous line
+func lineLevel(line []byte) string {
+	for i := 0; i < 3; i++ {
+		start := bytes.IndexByte(line, '[')
+		if start < 0 {
+			return ""
+		}
+		end := bytes.IndexByte(line[start:], ']')
+		if end < 0 {
+			return ""
+		}
+		level := string(line[start+1 : start+end])
+		if _, ok := logLevels[level]; ok {
+			return level
+		}
+		line = line[start+end:]
+	}
+	return ""
+}
+
+// logFilter keeps lines at or above a minimum level
+type logFilter struct {
+	min  int
+	last int
+}
+
+func (f *logFilter) keep(line []byte) bool {
+	if level := lineLevel(line); level != "" {
+		f.last = logLevels[level]
+	}
+	return f.last >= f.min
+}
+
+// logStream returns the IPED log of a job, following it while the job runs.
+// With "Accept: text/event-stream" each line is a Server-Sent Event whose id
+// is the offset after the line, otherwise lines are streamed as plain text.
+// "since" is the offset to start from and "level" the minimum level.
+func logStream(state *workerState) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		id := mux.Vars(r)["id"]
+		var job jobStatus
+		var ok bool
+		if id == "current" {
+			job, ok = state.current()
+		} else {
+			job, ok = state.job(id)
+		}
+		if !ok || job.LogPath == "" {
+			http.Error(w, "no such job", http.StatusNotFound)
+			return
+		}
+
+		since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+		if err != nil {
+			since = 0
+		}
+		if last := r.Header.Get("Last-Event-ID"); last != "" {
+			since, err = strconv.ParseInt(last, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid Last-Event-ID", http.StatusBadRequest)
+				return
+			}
+		}
+		filter := &logFilter{}
+		if level := strings.ToUpper(r.URL.Query().Get("level")); level != "" {
+			min, ok := logLevels[level]
+			if !ok {
+				http.Error(w, fmt.Sprintf("invalid level %q", level), http.StatusBadRequest)
+				return
+			}
+			filter.min = min
+		}
+
+		f, err := os.Open(job.LogPath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		defer func() {
+			f.Close()
+		}()
+		_, err = f.Seek(since, io.SeekStart)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+		if sse {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+		} else {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		flusher, _ := w.(http.Flusher)
+		writeLine := func(line []byte, offset int64) error {
+			if !filter.keep(line) {
+				return nil
+			}
+			var err error
+			if sse {
+				_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", offset, bytes.TrimRight(line, "\r"))
+			} else {
+				_, err = w.Write(append(line, '\n'))
+			}
+			return err
+		}
+		// after a rotation, offsets are in the new IPED.log
+		reopen := func() io.Reader {
+			info, err1 := f.Stat()
+			current, err2 := os.Stat(job.LogPath)
+			if err1 != nil || err2 != nil || os.SameFile(info, current) {
+				return nil
+			}
+			next, err := os.Open(job.LogPath)
+			if err != nil {
+				return nil
+			}
+			f = next
+			return f
+		}
+		tailLog(r, f, since, func() bool {
+			_, running := state.job(job.ID)
+			return running
+		}, reopen, writeLine, func() {
+			if flusher != nil {
+				flusher.Flush()
+			}
+		})
+	}
+}
+
+// tailLog reads complete lines from f until running returns false or the
+// client goes away. When reopen returns a reader, f was rotated: the rest of
+// f is read, f is closed and the tail continues from the start of the new
+// reader.
+func tailLog(r *http.Request, f io.Reader, offset int64, running func() bool, reopen func() io.Reader, writeLine func([]byte, int64) error, flush func()) {
+	buf := make([]byte, 32*1024)
+	pending := []byte{}
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	drain := func() bool {
+		for {
+			n, err := f.Read(buf)
+			pending = append(pending, buf[:n]...)
+			for {
+				i := bytes.IndexByte(pending, '\n')
+				if i < 0 {
+					break
+				}
+				offset += int64(i + 1)
+				if writeLine(pending[:i], offset) != nil {
+					return false
+				}
+				pending = pending[i+1:]
+			}
+			if err != nil || n == 0 {
+				return true
+			}
+		}
+	}
+	for {
+		finished := !running()
+		if !drain() {
+			return
+		}
+		if reopen != nil {
+			if next := reopen(); next != nil {
+				ok := drain()
+				if c, isCloser := f.(io.Closer); isCloser {
+					c.Close()
+				}
+				if !ok {
+					return
+				}
+				// a line cut by the rotation ends in the new file
+				f = next
+				offset = -int64(len(pending))
+				continue
+			}
+		}
+		if finished {
+			if len(pending) > 0 {
+				writeLine(pending, offset+int64(len(pending)))
+			}
+			flush()
+			return
+		}
+		flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const sampleLog = `HOSTNAME: worker-1
+2020-04-24 15:10:01	[INFO]	[indexer.process.Manager]	Indexing...
+2020-04-24 15:10:02	[WARN]	[indexer.parsers.OCRParser]	Timeout
+java.lang.Exception: boom
+	at Foo.bar(Foo.java:1)
+2020-04-24 15:12:43	[MSG]	[indexer.process.ProgressConsole]	Processando 2153/3591 (7%)
+2020-04-24 15:12:44	[ERROR]	[indexer.process.Worker]	Error processing item
+`
+
+func TestLogStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logPath := path.Join(dir, "IPED.log")
+	ioutil.WriteFile(logPath, []byte(sampleLog), 0644)
+
+	state := newWorkerState("", "")
+	job := state.start("job1", "/data/image.E01", 0)
+	job.setLogPath(logPath)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/jobs/{id}/log", logStream(state))
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	get := func(url string, header http.Header) string {
+		req, _ := http.NewRequest("GET", srv.URL+url, nil)
+		if header != nil {
+			req.Header = header
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	t.Run("follows the log until the job finishes", func(t *testing.T) {
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			f, _ := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0644)
+			f.WriteString("2020-04-24 15:13:00	[MSG]	[indexer.process.Manager]	Finished\n")
+			f.Close()
+			time.Sleep(600 * time.Millisecond)
+			job.finish()
+		}()
+		body := get("/jobs/current/log", nil)
+		if !strings.HasPrefix(body, sampleLog) || !strings.HasSuffix(body, "Finished\n") {
+			t.Errorf("unexpected log: %q", body)
+		}
+	})
+
+	runFor := func(d time.Duration) {
+		job := state.start("job1", "/data/image.E01", 0)
+		job.setLogPath(logPath)
+		go func() {
+			time.Sleep(d)
+			job.finish()
+		}()
+	}
+
+	t.Run("filters by level from an offset", func(t *testing.T) {
+		runFor(100 * time.Millisecond)
+		body := get("/jobs/job1/log?level=warn&since=19", nil)
+		lines := strings.Split(strings.TrimSpace(body), "\n")
+		if len(lines) != 4 {
+			t.Fatalf("expected: 4 lines, got: %q", lines)
+		}
+		if !strings.Contains(lines[0], "[WARN]") || !strings.HasPrefix(lines[1], "java.lang.Exception") || !strings.Contains(lines[3], "[ERROR]") {
+			t.Errorf("unexpected lines: %q", lines)
+		}
+	})
+
+	t.Run("server-sent events", func(t *testing.T) {
+		runFor(100 * time.Millisecond)
+		header := http.Header{}
+		header.Set("Accept", "text/event-stream")
+		header.Set("Last-Event-ID", "19")
+		body := get("/jobs/job1/log?level=ERROR", header)
+		if !strings.HasPrefix(body, "id: ") || !strings.Contains(body, "data: 2020-04-24 15:12:44\t[ERROR]") {
+			t.Errorf("unexpected events: %q", body)
+		}
+		if strings.Contains(body, "[WARN]") {
+			t.Errorf("unexpected WARN event: %q", body)
+		}
+	})
+
+	t.Run("unknown job", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/jobs/nope/log", nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("expected: %v, got: %v", http.StatusNotFound, rec.Code)
+		}
+	})
+}
+
+func TestTailLogRotation(t *testing.T) {
+	rotated := false
+	reopen := func() io.Reader {
+		if rotated {
+			return nil
+		}
+		rotated = true
+		return strings.NewReader("c\nd\n")
+	}
+	polls := 0
+	running := func() bool {
+		polls++
+		return polls < 3
+	}
+	lines := []string{}
+	offsets := []int64{}
+	r := httptest.NewRequest("GET", "/jobs/current/log", nil)
+	tailLog(r, strings.NewReader("a\nb"), 0, running, reopen, func(line []byte, offset int64) error {
+		lines = append(lines, string(line))
+		offsets = append(offsets, offset)
+		return nil
+	}, func() {})
+
+	if strings.Join(lines, ",") != "a,bc,d" {
+		t.Errorf("expected the line cut by the rotation to be joined, got: %q", lines)
+	}
+	if offsets[0] != 2 || offsets[1] != 2 || offsets[2] != 4 {
+		t.Errorf("expected offsets in the new file after the rotation, got: %v", offsets)
+	}
+}
@@ -1,39 +1,289 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
-func createIpedMetrics() ipedMetrics {
+// metricLabelNames are the labels that can be added to the aggregated
+// metrics. Evidence paths are unbounded, so only use them on short-lived
+// workers.
+var metricLabelNames = []string{"profile", "hostname", "evidence"}
+
+// parseMetricLabels parses a comma separated list of metricLabelNames
+func parseMetricLabels(s string) ([]string, error) {
+	labels := []string{}
+	for _, label := range strings.Split(s, ",") {
+		label = strings.TrimSpace(label)
+		if label == "" {
+			continue
+		}
+		known := false
+		for _, name := range metricLabelNames {
+			known = known || name == label
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown metric label %q, valid labels are %s", label, strings.Join(metricLabelNames, ", "))
+		}
+		labels = append(labels, label)
+	}
+	return labels, nil
+}
+
+// createIpedMetrics registers the worker metrics. The aggregated metrics
+// have the configured labels, per-job metrics have only the job id and are
+// deleted after retention once the job finishes. ipedworker_job_info maps the
+// job id to its evidence.
+func createIpedMetrics(labels []string, retention time.Duration) ipedMetrics {
+	resultLabels := append(append([]string{}, labels...), "result")
 	return ipedMetrics{
+		labels:    labels,
+		retention: retention,
+		timers:    &retentionTimers{timers: map[string]*time.Timer{}},
 		calls: promauto.NewCounterVec(prometheus.CounterOpts{
 			Name: "ipedworker_runIped_calls",
 			Help: "Number of calls to runIped",
-		}, []string{"hostname", "evidence"}),
+		}, labels),
 		finish: promauto.NewCounterVec(prometheus.CounterOpts{
 			Name: "ipedworker_runIped_finish",
-			Help: "Number of finished runs",
-		}, []string{"hostname", "evidence", "result"}),
+			Help: "Number of finished runs, by result and the step that failed",
+		}, append(append([]string{}, labels...), "result", "reason")),
 		running: promauto.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "ipedworker_runIped_running",
-			Help: "Whether IPED is running or not",
-		}, []string{"hostname", "evidence"}),
+			Help: "Number of IPED processes running",
+		}, labels),
+		jobInfo: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ipedworker_job_info",
+			Help: "Evidence and profile of a job, always 1",
+		}, []string{"job_id", "evidence", "profile", "hostname"}),
 		found: promauto.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "ipedworker_runIped_found",
 			Help: "Number of items found",
-		}, []string{"hostname", "evidence"}),
+		}, []string{"job_id"}),
 		processed: promauto.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "ipedworker_runIped_processed",
 			Help: "Number of items processed",
-		}, []string{"hostname", "evidence"}),
+		}, []string{"job_id"}),
+		percent: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ipedworker_progress_percent",
+			Help: "Percentage of the evidence processed, as printed by IPED",
+		}, []string{"job_id"}),
+		throughput: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ipedworker_throughput_bytes_per_hour",
+			Help: "Processing throughput, as printed by IPED",
+		}, []string{"job_id"}),
+		eta: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ipedworker_eta_seconds",
+			Help: "Estimated time to finish, as printed by IPED or estimated from the processed items rate",
+		}, []string{"job_id"}),
+		evidenceBytes: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ipedworker_evidence_bytes",
+			Help: "Size of the evidence and its additional paths",
+		}, []string{"job_id"}),
+		outputBytes: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ipedworker_output_bytes",
+			Help: "Size of the case folder after post-processing",
+		}, []string{"job_id"}),
+		jobStart: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ipedworker_job_start_timestamp_seconds",
+			Help: "Start time of a job since the Unix epoch",
+		}, []string{"job_id"}),
+		jobEnd: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ipedworker_job_end_timestamp_seconds",
+			Help: "End time of a job since the Unix epoch",
+		}, []string{"job_id"}),
+		lockWait: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ipedworker_lock_wait_seconds",
+			Help:    "Time waiting for the evidence lock",
+			Buckets: prometheus.ExponentialBuckets(0.1, 4, 10),
+		}, resultLabels),
+		jobDuration: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ipedworker_job_duration_seconds",
+			Help:    "Total duration of a job, from validation to the final event",
+			Buckets: prometheus.ExponentialBuckets(60, 2, 14),
+		}, resultLabels),
+		ipedDuration: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ipedworker_iped_duration_seconds",
+			Help:    "Run time of the IPED process",
+			Buckets: prometheus.ExponentialBuckets(60, 2, 14),
+		}, resultLabels),
+		postActionsDuration: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ipedworker_post_actions_duration_seconds",
+			Help:    "Time applying permissions to the case folder",
+			Buckets: prometheus.ExponentialBuckets(1, 3, 12),
+		}, resultLabels),
+		moveDuration: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ipedworker_move_duration_seconds",
+			Help:    "Time moving the case folder to MV_PATH",
+			Buckets: prometheus.ExponentialBuckets(1, 3, 12),
+		}, resultLabels),
+		phase: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ipedworker_phase",
+			Help: "Whether IPED is in a phase (opening, enumerating, processing, committing, reporting) or not",
+		}, []string{"job_id", "phase"}),
+		phaseDuration: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ipedworker_phase_duration_seconds",
+			Help:    "Duration of the IPED phases",
+			Buckets: prometheus.ExponentialBuckets(30, 2, 14),
+		}, []string{"phase"}),
 	}
 }
 
 type ipedMetrics struct {
-	calls     *prometheus.CounterVec
-	finish    *prometheus.CounterVec
-	running   *prometheus.GaugeVec
-	found     *prometheus.GaugeVec
-	processed *prometheus.GaugeVec
+	labels    []string
+	retention time.Duration
+	timers    *retentionTimers
+
+	calls   *prometheus.CounterVec
+	finish  *prometheus.CounterVec
+	running *prometheus.GaugeVec
+	jobInfo *prometheus.GaugeVec
+
+	found      *prometheus.GaugeVec
+	processed  *prometheus.GaugeVec
+	percent    *prometheus.GaugeVec
+	throughput *prometheus.GaugeVec
+	eta        *prometheus.GaugeVec
+
+	evidenceBytes *prometheus.GaugeVec
+	outputBytes   *prometheus.GaugeVec
+
+	jobStart            *prometheus.GaugeVec
+	jobEnd              *prometheus.GaugeVec
+	lockWait            *prometheus.HistogramVec
+	jobDuration         *prometheus.HistogramVec
+	ipedDuration        *prometheus.HistogramVec
+	postActionsDuration *prometheus.HistogramVec
+	moveDuration        *prometheus.HistogramVec
+
+	phase         *prometheus.GaugeVec
+	phaseDuration *prometheus.HistogramVec
+}
+
+// labelValues are the values of the configured labels for a job, followed
+// by extra
+func (m ipedMetrics) labelValues(params ipedParams, extra ...string) []string {
+	values := make([]string, 0, len(m.labels)+len(extra))
+	for _, label := range m.labels {
+		switch label {
+		case "profile":
+			values = append(values, params.profile)
+		case "hostname":
+			hostname, _ := os.Hostname()
+			values = append(values, hostname)
+		case "evidence":
+			values = append(values, params.evidence)
+		}
+	}
+	return append(values, extra...)
+}
+
+// retentionTimers are the pending deletions of per-job series, by job id
+type retentionTimers struct {
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+}
+
+// cancel stops the pending deletion of the series of job id, if any
+func (r *retentionTimers) cancel(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t, ok := r.timers[id]; ok {
+		t.Stop()
+		delete(r.timers, id)
+	}
+}
+
+// after calls f after d unless the job id is cancelled or scheduled again
+// first
+func (r *retentionTimers) after(id string, d time.Duration, f func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t, ok := r.timers[id]; ok {
+		t.Stop()
+	}
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		// a timer that fired while it was replaced or cancelled is stale
+		if r.timers[id] != t {
+			return
+		}
+		delete(r.timers, id)
+		f()
+	})
+	r.timers[id] = t
+}
+
+// jobStarted cancels the deletion of the series of a previous run of the
+// same job id, like a retry, and records the job info
+func (m ipedMetrics) jobStarted(params ipedParams) {
+	m.timers.cancel(params.id)
+	hostname, _ := os.Hostname()
+	m.jobInfo.WithLabelValues(params.id, params.evidence, params.profile, hostname).Set(1)
+}
+
+// jobFinished deletes the per-job series after the retention window
+func (m ipedMetrics) jobFinished(params ipedParams) {
+	m.timers.after(params.id, m.retention, func() {
+		m.forgetJob(params)
+	})
+}
+
+func (m ipedMetrics) forgetJob(params ipedParams) {
+	hostname, _ := os.Hostname()
+	m.jobInfo.DeleteLabelValues(params.id, params.evidence, params.profile, hostname)
+	for _, gauge := range []*prometheus.GaugeVec{m.found, m.processed, m.percent, m.throughput, m.eta, m.evidenceBytes, m.outputBytes, m.jobStart, m.jobEnd} {
+		gauge.DeleteLabelValues(params.id)
+	}
+	for _, phase := range ipedPhases {
+		m.phase.DeleteLabelValues(params.id, phase)
+	}
+}
+
+// jobTimings are the durations of the steps of a job, observed when the job
+// finishes so they can be labeled by its result. Negative is not measured.
+type jobTimings struct {
+	start       time.Time
+	lockWait    time.Duration
+	iped        time.Duration
+	postActions time.Duration
+	move        time.Duration
+}
+
+func newJobTimings(start time.Time) *jobTimings {
+	return &jobTimings{
+		start:       start,
+		lockWait:    -1,
+		iped:        -1,
+		postActions: -1,
+		move:        -1,
+	}
+}
+
+func (m ipedMetrics) observeTimings(params ipedParams, timings *jobTimings, end time.Time, result string) {
+	values := m.labelValues(params, result)
+	m.jobEnd.WithLabelValues(params.id).Set(float64(end.UnixNano()) / 1e9)
+	m.jobDuration.WithLabelValues(values...).Observe(end.Sub(timings.start).Seconds())
+	histograms := []struct {
+		h *prometheus.HistogramVec
+		d time.Duration
+	}{
+		{m.lockWait, timings.lockWait},
+		{m.ipedDuration, timings.iped},
+		{m.postActionsDuration, timings.postActions},
+		{m.moveDuration, timings.move},
+	}
+	for _, h := range histograms {
+		if h.d >= 0 {
+			h.h.WithLabelValues(values...).Observe(h.d.Seconds())
+		}
+	}
 }
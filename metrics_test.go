@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// testMetrics are registered once, the registry rejects duplicates
+var testMetrics = createIpedMetrics([]string{"profile"}, 0)
+
+// seriesCount counts the series of a metric in the default registry
+func seriesCount(t *testing.T, name string) int {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == name {
+			return len(family.GetMetric())
+		}
+	}
+	return 0
+}
+
+func TestParseMetricLabels(t *testing.T) {
+	labels, err := parseMetricLabels("profile, hostname")
+	if err != nil || len(labels) != 2 || labels[1] != "hostname" {
+		t.Errorf("unexpected labels: %v %v", labels, err)
+	}
+	if _, err := parseMetricLabels("profile,job"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestJobMetrics(t *testing.T) {
+	params := ipedParams{id: "job1", evidence: "/data/mat1/image.E01", profile: "forensic"}
+	m := testMetrics
+	if got := m.labelValues(params, "failed", "iped"); len(got) != 3 || got[0] != "forensic" {
+		t.Errorf("unexpected label values: %v", got)
+	}
+
+	m.jobStarted(params)
+	m.processed.WithLabelValues(params.id).Set(10)
+	m.phase.WithLabelValues(params.id, "processing").Set(1)
+	m.finish.WithLabelValues(m.labelValues(params, "failed", "iped")...).Inc()
+	for _, name := range []string{"ipedworker_job_info", "ipedworker_runIped_processed", "ipedworker_phase", "ipedworker_runIped_finish"} {
+		if seriesCount(t, name) != 1 {
+			t.Errorf("expected a %s series", name)
+		}
+	}
+
+	families, _ := prometheus.DefaultGatherer.Gather()
+	for _, family := range families {
+		if family.GetName() != "ipedworker_runIped_processed" {
+			continue
+		}
+		if label := family.GetMetric()[0].GetLabel()[0]; label.GetName() != "job_id" || label.GetValue() != "job1" {
+			t.Errorf("expected a job_id label, got: %v", label)
+		}
+	}
+
+	m.forgetJob(params)
+	for _, name := range []string{"ipedworker_job_info", "ipedworker_runIped_processed", "ipedworker_phase"} {
+		if n := seriesCount(t, name); n != 0 {
+			t.Errorf("expected no %s series, got: %v", name, n)
+		}
+	}
+	if seriesCount(t, "ipedworker_runIped_finish") != 1 {
+		t.Error("expected the aggregated series to be kept")
+	}
+}
+
+func TestRetentionTimers(t *testing.T) {
+	r := &retentionTimers{timers: map[string]*time.Timer{}}
+	calls := make(chan string, 3)
+	r.after("job1", 10*time.Millisecond, func() { calls <- "job1" })
+	r.cancel("job1")
+	r.after("job2", 10*time.Millisecond, func() { calls <- "first job2" })
+	r.after("job2", 20*time.Millisecond, func() { calls <- "job2" })
+	time.Sleep(100 * time.Millisecond)
+	got := []string{}
+	for len(calls) > 0 {
+		got = append(got, <-calls)
+	}
+	if len(got) != 1 || got[0] != "job2" {
+		t.Errorf("expected: [job2], got: %v", got)
+	}
+}
+
+func TestFailureReason(t *testing.T) {
+	if reason := failureReason(failure("lock", errTest)); reason != "lock" {
+		t.Errorf("expected: lock, got: %v", reason)
+	}
+	if failure("lock", nil) != nil {
+		t.Error("expected nil")
+	}
+	if reason := failureReason(errTest); reason != "unknown" {
+		t.Errorf("expected: unknown, got: %v", reason)
+	}
+}
+
+var errTest = errors.New("test")
+
+func TestObserveTimings(t *testing.T) {
+	params := ipedParams{id: "job2", profile: "forensic"}
+	timings := newJobTimings(time.Unix(1000, 0))
+	timings.lockWait = time.Second
+	timings.iped = time.Hour
+	testMetrics.observeTimings(params, timings, time.Unix(5000, 0), "done")
+	for _, name := range []string{"ipedworker_lock_wait_seconds", "ipedworker_iped_duration_seconds", "ipedworker_job_duration_seconds", "ipedworker_job_end_timestamp_seconds"} {
+		if seriesCount(t, name) != 1 {
+			t.Errorf("expected a %s series", name)
+		}
+	}
+	for _, name := range []string{"ipedworker_post_actions_duration_seconds", "ipedworker_move_duration_seconds"} {
+		if n := seriesCount(t, name); n != 0 {
+			t.Errorf("expected no %s series, got: %v", name, n)
+		}
+	}
+	testMetrics.forgetJob(params)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// moveCase moves the case folder to dst, or into dst if it is a folder,
+// copying it when a rename is not possible (e.g. across filesystems). A copy
+// goes to a temporary folder next to dst and is checked against the source
+// before it is renamed to dst and the source removed, a failed copy is
+// removed.
+func moveCase(src, dst string) (string, error) {
+	info, err := os.Stat(dst)
+	if err == nil && info.IsDir() {
+		dst = filepath.Join(dst, filepath.Base(src))
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return "", fmt.Errorf("could not move %s: %s exists", src, dst)
+	}
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(src, dst)
+	if err == nil {
+		return dst, nil
+	}
+	err = copyCase(src, dst)
+	if err != nil {
+		return "", err
+	}
+	return dst, os.RemoveAll(src)
+}
+
+// copyCase copies src to dst through a temporary folder next to dst, so dst
+// only appears once the copy is complete and checked
+func copyCase(src, dst string) error {
+	tmp := filepath.Join(filepath.Dir(dst), fmt.Sprintf(".%s.moving-%d", filepath.Base(dst), os.Getpid()))
+	err := copyTree(src, tmp)
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("could not copy %s to %s: %v", src, dst, err)
+	}
+	return nil
+}
+
+// copiedEntry is what copyTree copied of an entry, to check the copy
+type copiedEntry struct {
+	mode os.FileMode
+	size int64
+	sum  []byte
+}
+
+// copyTree copies files, folders and symlinks keeping their modes, owners,
+// ACLs and modification times, then checks that the copy has the same
+// entries, sizes and contents as what was read from src
+func copyTree(src, dst string) error {
+	copied := map[string]copiedEntry{}
+	dirs := []string{}
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		entry := copiedEntry{mode: info.Mode() & os.ModeType}
+		switch {
+		case info.IsDir():
+			err = os.Mkdir(target, 0700)
+			dirs = append(dirs, rel)
+		case info.Mode()&os.ModeSymlink != 0:
+			var link string
+			link, err = os.Readlink(p)
+			if err == nil {
+				err = os.Symlink(link, target)
+			}
+		case info.Mode().IsRegular():
+			entry.size, entry.sum, err = copyFile(p, target)
+		default:
+			return fmt.Errorf("could not copy %s: unsupported file type", p)
+		}
+		if err != nil {
+			return err
+		}
+		copied[rel] = entry
+		if info.IsDir() {
+			// folders get their metadata once their content is copied
+			return nil
+		}
+		return copyMetadata(p, target, info)
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		p := filepath.Join(src, dirs[i])
+		info, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		err = copyMetadata(p, filepath.Join(dst, dirs[i]), info)
+		if err != nil {
+			return err
+		}
+	}
+	return verifyTree(dst, copied)
+}
+
+// copyMetadata gives target the mode, owner, ACLs and modification time of
+// src, whatever the umask
+func copyMetadata(src, target string, info os.FileInfo) error {
+	err := copyOwner(target, info)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	err = os.Chmod(target, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+	if err != nil {
+		return err
+	}
+	err = copyACL(src, target)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(target, info.ModTime(), info.ModTime())
+}
+
+// verifyTree checks the copy in dst against the entries copied to it
+func verifyTree(dst string, copied map[string]copiedEntry) error {
+	seen := 0
+	err := filepath.Walk(dst, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dst, p)
+		if err != nil {
+			return err
+		}
+		entry, ok := copied[rel]
+		if !ok {
+			return fmt.Errorf("unexpected %s in the copy", rel)
+		}
+		seen++
+		if info.Mode()&os.ModeType != entry.mode {
+			return fmt.Errorf("%s has another type in the copy", rel)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if info.Size() != entry.size {
+			return fmt.Errorf("%s has %d bytes in the copy, expected %d", rel, info.Size(), entry.size)
+		}
+		sum, err := fileSum(p)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(sum, entry.sum) {
+			return fmt.Errorf("%s differs in the copy", rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if seen != len(copied) {
+		return fmt.Errorf("the copy has %d entries, expected %d", seen, len(copied))
+	}
+	return nil
+}
+
+// copyFile copies src to a new file dst, returning the size and SHA-256 of
+// what was read
+func copyFile(src, dst string) (int64, []byte, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, nil, err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(out, io.TeeReader(in, hash))
+	if err != nil {
+		out.Close()
+		return 0, nil, err
+	}
+	err = out.Sync()
+	if err != nil {
+		out.Close()
+		return 0, nil, err
+	}
+	return n, hash.Sum(nil), out.Close()
+}
+
+func fileSum(p string) ([]byte, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
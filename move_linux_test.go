@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestCopyCaseCleansUp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "move")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "SARD")
+	os.MkdirAll(src, 0755)
+	ioutil.WriteFile(filepath.Join(src, logName), []byte("log"), 0644)
+	err = syscall.Mkfifo(filepath.Join(src, "pipe"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "done", "SARD")
+	os.MkdirAll(filepath.Dir(dst), 0755)
+
+	if err := copyCase(src, dst); err == nil {
+		t.Fatal("expected error")
+	}
+	entries, _ := ioutil.ReadDir(filepath.Dir(dst))
+	for _, entry := range entries {
+		t.Errorf("expected no partial copy, found: %s", entry.Name())
+	}
+	if _, err := os.Stat(filepath.Join(src, logName)); err != nil {
+		t.Errorf("expected the source to be kept: %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCopyTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "move")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "case")
+	os.MkdirAll(filepath.Join(src, "indexador", "index"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "indexador", "index", "segments"), []byte("index"), 0640)
+	ioutil.WriteFile(filepath.Join(src, "IPED-SearchApp.exe"), []byte("app"), 0751)
+	os.Symlink("indexador", filepath.Join(src, "link"))
+	old := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chtimes(filepath.Join(src, "IPED-SearchApp.exe"), old, old)
+	os.Chmod(filepath.Join(src, "indexador"), 0710)
+
+	dst := filepath.Join(dir, "copy")
+	err = copyTree(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]os.FileMode{
+		"indexador": os.ModeDir | 0710,
+		filepath.Join("indexador", "index", "segments"): 0640,
+		"IPED-SearchApp.exe":                            0751,
+		"link":                                          os.ModeSymlink,
+		filepath.Join("indexador", "index"):             os.ModeDir | 0755,
+	}
+	for rel, expect := range cases {
+		info, err := os.Lstat(filepath.Join(dst, rel))
+		if err != nil {
+			t.Errorf("%s: %v", rel, err)
+			continue
+		}
+		got := info.Mode()
+		if got&os.ModeSymlink != 0 {
+			got = os.ModeSymlink
+		}
+		if got != expect {
+			t.Errorf("%s: expected mode: %v, got: %v", rel, expect, got)
+		}
+	}
+	info, _ := os.Stat(filepath.Join(dst, "IPED-SearchApp.exe"))
+	if !info.ModTime().Equal(old) {
+		t.Errorf("expected modification time: %v, got: %v", old, info.ModTime())
+	}
+	srcOwner, srcGroup, _ := fileOwner(filepath.Join(src, "indexador"))
+	owner, group, _ := fileOwner(filepath.Join(dst, "indexador"))
+	if owner != srcOwner || group != srcGroup {
+		t.Errorf("expected owner: %d:%d, got: %d:%d", srcOwner, srcGroup, owner, group)
+	}
+}
+
+func TestVerifyTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "move")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	os.MkdirAll(src, 0755)
+	ioutil.WriteFile(filepath.Join(src, "file"), []byte("evidence"), 0644)
+	dst := filepath.Join(dir, "dst")
+	os.MkdirAll(dst, 0755)
+	size, sum, err := copyFile(filepath.Join(src, "file"), filepath.Join(dst, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied := map[string]copiedEntry{
+		".":    {mode: os.ModeDir},
+		"file": {size: size, sum: sum},
+	}
+	if err := verifyTree(dst, copied); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	ioutil.WriteFile(filepath.Join(dst, "file"), []byte("evidencE"), 0644)
+	if err := verifyTree(dst, copied); err == nil {
+		t.Error("expected error for changed content")
+	}
+	ioutil.WriteFile(filepath.Join(dst, "file"), []byte("evidence"), 0644)
+	ioutil.WriteFile(filepath.Join(dst, "extra"), nil, 0644)
+	if err := verifyTree(dst, copied); err == nil {
+		t.Error("expected error for an unexpected file")
+	}
+	os.Remove(filepath.Join(dst, "extra"))
+	os.Remove(filepath.Join(dst, "file"))
+	if err := verifyTree(dst, copied); err == nil {
+		t.Error("expected error for a missing file")
+	}
+}
+
+func TestMoveCase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "move")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "SARD")
+	os.MkdirAll(src, 0755)
+	ioutil.WriteFile(filepath.Join(src, logName), []byte("log"), 0644)
+	dst := filepath.Join(dir, "done")
+	os.MkdirAll(dst, 0755)
+
+	moved, err := moveCase(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != filepath.Join(dst, "SARD") {
+		t.Errorf("expected: %s, got: %s", filepath.Join(dst, "SARD"), moved)
+	}
+	if _, err := os.Stat(filepath.Join(moved, logName)); err != nil {
+		t.Error(err)
+	}
+
+	os.MkdirAll(src, 0755)
+	if _, err := moveCase(src, dst); err == nil {
+		t.Error("expected error when the destination exists")
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("expected the source to be kept: %v", err)
+	}
+}
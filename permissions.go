@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// permPolicy describes the permissions applied to an IPED case folder
+type permPolicy struct {
+	// RunningMode is set on the case folder while IPED is running
+	RunningMode os.FileMode
+	// DoneMode is set on the case folder after IPED finishes
+	DoneMode os.FileMode
+	// Rules are applied, in order, after IPED finishes
+	Rules []permRule
+	// UID and GID are the case owner, -1 leaves it unchanged
+	UID int
+	GID int
+	// ACL entries are added to every file of the case folder
+	ACL []aclEntry
+}
+
+// permRule applies Mode to every path matching Pattern, recursively
+type permRule struct {
+	Pattern string
+	Mode    permMode
+}
+
+// permMode is a chmod-like mode, either absolute ("0755") or symbolic ("a+x")
+type permMode struct {
+	absolute bool
+	perm     os.FileMode
+	clauses  []modeClause
+}
+
+type modeClause struct {
+	who   os.FileMode
+	op    byte
+	perm  os.FileMode
+	xOnly bool
+}
+
+// aclEntry is a POSIX ACL entry for a named user or group
+type aclEntry struct {
+	Group bool
+	ID    int
+	Perm  os.FileMode
+}
+
+type permFailure struct {
+	Path string
+	Err  error
+}
+
+// permReport summarizes what the permission policy did to a case folder.
+// Changed counts the paths whose mode, owner or ACL changed.
+type permReport struct {
+	Changed int
+	Missing []string
+	Failed  []permFailure
+}
+
+type permCounts struct {
+	Changed int `json:"changed"`
+	Missing int `json:"missing"`
+	Failed  int `json:"failed"`
+}
+
+func (r permReport) counts() *permCounts {
+	return &permCounts{
+		Changed: r.Changed,
+		Missing: len(r.Missing),
+		Failed:  len(r.Failed),
+	}
+}
+
+func defaultPermPolicy() permPolicy {
+	ax := mustParseMode("a+x")
+	return permPolicy{
+		RunningMode: 0750,
+		DoneMode:    0755,
+		Rules: []permRule{
+			{Pattern: "Ferramenta de Pesquisa.exe", Mode: ax},
+			{Pattern: "IPED-SearchApp.exe", Mode: ax},
+			{Pattern: "indexador/tools", Mode: ax},
+			{Pattern: "indexador/jre/bin", Mode: ax},
+			{Pattern: "indexador/lib", Mode: ax},
+		},
+		UID: -1,
+		GID: -1,
+	}
+}
+
+// parsePermRules parses "pattern=mode" entries separated by newlines or ';'
+func parsePermRules(s string) ([]permRule, error) {
+	rules := []permRule{}
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == ';' }) {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		i := strings.LastIndex(line, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid permission rule %q, expected pattern=mode", line)
+		}
+		mode, err := parseMode(line[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, permRule{
+			Pattern: strings.TrimSpace(line[:i]),
+			Mode:    mode,
+		})
+	}
+	return rules, nil
+}
+
+// parseOwner parses "uid:gid", "uid" or ":gid"
+func parseOwner(s string) (int, int, error) {
+	uid, gid := -1, -1
+	if s == "" {
+		return uid, gid, nil
+	}
+	parts := strings.SplitN(s, ":", 2)
+	var err error
+	if parts[0] != "" {
+		uid, err = strconv.Atoi(parts[0])
+		if err != nil {
+			return -1, -1, fmt.Errorf("invalid owner %q: %v", s, err)
+		}
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		gid, err = strconv.Atoi(parts[1])
+		if err != nil {
+			return -1, -1, fmt.Errorf("invalid owner %q: %v", s, err)
+		}
+	}
+	return uid, gid, nil
+}
+
+// parseACL parses comma separated entries like "g:1001:rx,u:1000:rwx"
+func parseACL(s string) ([]aclEntry, error) {
+	entries := []aclEntry{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid ACL entry %q, expected u:id:perm or g:id:perm", item)
+		}
+		entry := aclEntry{}
+		switch parts[0] {
+		case "u", "user":
+		case "g", "group":
+			entry.Group = true
+		default:
+			return nil, fmt.Errorf("invalid ACL entry %q: unknown tag %q", item, parts[0])
+		}
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid ACL entry %q: %v", item, err)
+		}
+		entry.ID = id
+		for _, c := range parts[2] {
+			switch c {
+			case 'r':
+				entry.Perm |= 04
+			case 'w':
+				entry.Perm |= 02
+			case 'x':
+				entry.Perm |= 01
+			case '-':
+			default:
+				return nil, fmt.Errorf("invalid ACL entry %q: unknown permission %q", item, c)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// parseOctalMode parses the permission bits of an octal mode. Setuid, setgid
+// and sticky are not os.FileMode bits 04000, 02000 and 01000, so they are
+// rejected.
+func parseOctalMode(s string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("invalid octal mode %q", s)
+	}
+	return os.FileMode(m), nil
+}
+
+func mustParseMode(s string) permMode {
+	m, err := parseMode(s)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// parseMode parses an octal mode or a symbolic mode in chmod syntax
+func parseMode(s string) (permMode, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return permMode{}, fmt.Errorf("empty mode")
+	}
+	if s[0] >= '0' && s[0] <= '7' {
+		perm, err := parseOctalMode(s)
+		if err != nil {
+			return permMode{}, err
+		}
+		return permMode{absolute: true, perm: perm}, nil
+	}
+	mode := permMode{}
+	for _, part := range strings.Split(s, ",") {
+		clause := modeClause{}
+		i := 0
+		for ; i < len(part) && strings.IndexByte("ugoa", part[i]) >= 0; i++ {
+			switch part[i] {
+			case 'u':
+				clause.who |= 0700
+			case 'g':
+				clause.who |= 0070
+			case 'o':
+				clause.who |= 0007
+			case 'a':
+				clause.who |= 0777
+			}
+		}
+		if clause.who == 0 {
+			clause.who = 0777
+		}
+		if i >= len(part) || strings.IndexByte("+-=", part[i]) < 0 {
+			return permMode{}, fmt.Errorf("invalid mode %q", s)
+		}
+		clause.op = part[i]
+		for _, c := range part[i+1:] {
+			switch c {
+			case 'r':
+				clause.perm |= 0444
+			case 'w':
+				clause.perm |= 0222
+			case 'x':
+				clause.perm |= 0111
+			case 'X':
+				clause.perm |= 0111
+				clause.xOnly = true
+			default:
+				return permMode{}, fmt.Errorf("invalid mode %q", s)
+			}
+		}
+		mode.clauses = append(mode.clauses, clause)
+	}
+	return mode, nil
+}
+
+// apply returns the new permission bits for a file with the current mode
+func (m permMode) apply(current os.FileMode) os.FileMode {
+	if m.absolute {
+		return m.perm
+	}
+	perm := current.Perm()
+	for _, c := range m.clauses {
+		bits := c.perm & c.who
+		if c.xOnly && !current.IsDir() && current&0111 == 0 {
+			bits &^= 0111
+		}
+		switch c.op {
+		case '+':
+			perm |= bits
+		case '-':
+			perm &^= bits
+		case '=':
+			perm = perm&^c.who | bits
+		}
+	}
+	return perm
+}
+
+// applyPermPolicy applies the rules, ownership and ACLs to a case folder
+func applyPermPolicy(ipedfolder string, policy permPolicy) permReport {
+	report := permReport{}
+	// a path the rules, owner and ACL passes change is counted once
+	changed := map[string]bool{}
+	for _, rule := range policy.Rules {
+		matches, err := filepath.Glob(filepath.Join(ipedfolder, rule.Pattern))
+		if err != nil {
+			report.Failed = append(report.Failed, permFailure{Path: rule.Pattern, Err: err})
+			continue
+		}
+		if len(matches) == 0 {
+			report.Missing = append(report.Missing, rule.Pattern)
+			continue
+		}
+		for _, match := range matches {
+			walkCase(match, &report, changed, func(p string, info os.FileInfo) (bool, error) {
+				perm := rule.Mode.apply(info.Mode())
+				if perm == info.Mode().Perm() {
+					return false, nil
+				}
+				return true, os.Chmod(p, perm)
+			})
+		}
+	}
+	if policy.UID >= 0 || policy.GID >= 0 {
+		walkCase(ipedfolder, &report, changed, func(p string, info os.FileInfo) (bool, error) {
+			uid, gid, ok := infoOwner(info)
+			if ok && (policy.UID < 0 || policy.UID == uid) && (policy.GID < 0 || policy.GID == gid) {
+				return false, nil
+			}
+			return true, os.Lchown(p, policy.UID, policy.GID)
+		})
+	}
+	if len(policy.ACL) > 0 {
+		walkCase(ipedfolder, &report, changed, func(p string, info os.FileInfo) (bool, error) {
+			return setACL(p, info.Mode(), policy.ACL)
+		})
+	}
+	report.Changed = len(changed)
+	for _, missing := range report.Missing {
+		logger.Warn("permission rule matched nothing", "rule", missing)
+	}
+	for _, failed := range report.Failed {
+		logger.Warn("could not apply permissions", "path", failed.Path, "err", failed.Err)
+	}
+	return report
+}
+
+// walkCase calls f for root and, if it is a directory, everything below it,
+// adding the paths f changed to changed. Symbolic links are not followed nor
+// changed.
+func walkCase(root string, report *permReport, changed map[string]bool, f func(string, os.FileInfo) (bool, error)) {
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			report.Failed = append(report.Failed, permFailure{Path: p, Err: err})
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		ok, err := f(p, info)
+		if err != nil {
+			report.Failed = append(report.Failed, permFailure{Path: p, Err: err})
+			return nil
+		}
+		if ok {
+			changed[p] = true
+		}
+		return nil
+	})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseMode(t *testing.T) {
+	cases := []struct {
+		mode    string
+		current os.FileMode
+		expect  os.FileMode
+	}{
+		{"a+x", 0644, 0755},
+		{"0750", 0644, 0750},
+		{"g-w,o=r", 0666, 0644},
+		{"u+rwx", 0000, 0700},
+		{"a+X", 0644, 0644},
+		{"a+X", 0744, 0755},
+		{"a+X", os.ModeDir | 0700, 0711},
+	}
+	for _, c := range cases {
+		m, err := parseMode(c.mode)
+		if err != nil {
+			t.Errorf("mode %s: unexpected error: %v", c.mode, err)
+			continue
+		}
+		got := m.apply(c.current)
+		if got != c.expect {
+			t.Errorf("mode %s on %o: expected: %o, got: %o", c.mode, c.current, c.expect, got)
+		}
+	}
+	for _, invalid := range []string{"", "a", "a+z", "0999", "04755", "u*x"} {
+		if _, err := parseMode(invalid); err == nil {
+			t.Errorf("mode %q: expected error", invalid)
+		}
+	}
+}
+
+func TestParsePermRules(t *testing.T) {
+	rules, err := parsePermRules("Ferramenta de Pesquisa.exe=a+x;indexador/lib=0755\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("expected: 2 rules, got: %v", len(rules))
+	}
+	if rules[0].Pattern != "Ferramenta de Pesquisa.exe" {
+		t.Errorf("unexpected pattern: %q", rules[0].Pattern)
+	}
+	if _, err := parsePermRules("noequals"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestParseOwnerAndACL(t *testing.T) {
+	uid, gid, err := parseOwner(":1001")
+	if err != nil || uid != -1 || gid != 1001 {
+		t.Errorf("unexpected owner: %v %v %v", uid, gid, err)
+	}
+	acl, err := parseACL("g:1001:rx,u:1000:rwx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []aclEntry{{Group: true, ID: 1001, Perm: 05}, {ID: 1000, Perm: 07}}
+	for i := range expect {
+		if acl[i] != expect[i] {
+			t.Errorf("expected: %v, got: %v", expect[i], acl[i])
+		}
+	}
+	if _, err := parseACL("x:1:r"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestApplyPermPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "perms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "indexador", "tools"), 0755)
+	tool := filepath.Join(dir, "indexador", "tools", "tool.sh")
+	ioutil.WriteFile(tool, []byte{}, 0644)
+
+	report := applyPermPolicy(dir, defaultPermPolicy())
+	info, err := os.Stat(tool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("expected: %o, got: %o", 0755, info.Mode().Perm())
+	}
+	if report.Changed != 1 {
+		t.Errorf("expected: 1 changed, got: %v", report.Changed)
+	}
+	if len(report.Missing) != 4 {
+		t.Errorf("expected: 4 missing, got: %v", report.Missing)
+	}
+	if len(report.Failed) != 0 {
+		t.Errorf("unexpected failures: %v", report.Failed)
+	}
+
+	// a path is counted once, and only if it changes
+	policy := defaultPermPolicy()
+	policy.Rules = append(policy.Rules, permRule{Pattern: "indexador", Mode: mustParseMode("a+x")})
+	policy.UID, policy.GID = os.Getuid(), os.Getgid()
+	os.Chmod(tool, 0644)
+	report = applyPermPolicy(dir, policy)
+	if report.Changed != 1 || len(report.Failed) != 0 {
+		t.Errorf("expected: 1 changed, got: %v %v", report.Changed, report.Failed)
+	}
+	report = applyPermPolicy(dir, policy)
+	if report.Changed != 0 {
+		t.Errorf("expected nothing changed again, got: %v", report.Changed)
+	}
+}
+
+func TestApplyPermPolicyACL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "perms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte{}, 0644)
+	policy := permPolicy{UID: -1, GID: -1}
+	policy.ACL, _ = parseACL("g:1001:rwx")
+
+	report := applyPermPolicy(dir, policy)
+	if len(report.Failed) != 0 {
+		t.Skipf("ACLs not supported here: %v", report.Failed[0].Err)
+	}
+	if report.Changed != 2 {
+		t.Errorf("expected: 2 changed, got: %v", report.Changed)
+	}
+	// the group bits are the mask now, the owning group is unchanged
+	report = applyPermPolicy(dir, policy)
+	if report.Changed != 0 || len(report.Failed) != 0 {
+		t.Errorf("expected nothing changed again, got: %v %v", report.Changed, report.Failed)
+	}
+}
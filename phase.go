@@ -0,0 +1,130 @@
+package main
+
+import (
+	"regexp"
+	"sync"
+	"time"
+)
+
+// ipedPhases are the stages of an IPED run, in order
+var ipedPhases = []string{"opening", "enumerating", "processing", "committing", "reporting"}
+
+// phasePatterns match the loggers of the IPED log lines that start each
+// phase, by class name so they match whatever the locale and package:
+// the data source readers open the images, ItemProducer enumerates their
+// items and HTMLReportTask writes the report. Processing starts with the
+// first progress line and committing with the one that has every item
+// found processed.
+var phasePatterns = map[string]*regexp.Regexp{
+	"opening":     regexp.MustCompile(`\[[\w.]*Reader\]`),
+	"enumerating": regexp.MustCompile(`\[[\w.]*ItemProducer\]`),
+	"reporting":   regexp.MustCompile(`\[[\w.]*HTMLReportTask\]`),
+}
+
+// phaseTransition is when a phase started
+type phaseTransition struct {
+	Phase string    `json:"phase"`
+	Time  time.Time `json:"time"`
+}
+
+// phaseDetector follows the IPED log lines and tells when the run moves to
+// a later phase. Phases only move forward.
+type phaseDetector struct {
+	mu          sync.Mutex
+	progress    progressParser
+	current     int
+	transitions []phaseTransition
+	// onChange is called with the finished phase (or "" for the first one)
+	// and how long it took
+	onChange func(from, to string, at time.Time, took time.Duration)
+	// onFinish is called when the run ends during a phase
+	onFinish func(phase string, took time.Duration)
+}
+
+func newPhaseDetector(progress progressParser) *phaseDetector {
+	return &phaseDetector{
+		progress: progress,
+		current:  -1,
+	}
+}
+
+func (d *phaseDetector) detect(line string) int {
+	for i := len(ipedPhases) - 1; i > d.current; i-- {
+		phase := ipedPhases[i]
+		if phase == "processing" || phase == "committing" {
+			processed, found, ok := d.progress.parse(event{Type: "progress", Payload: eventPayload{Progress: line}})
+			if ok && (phase == "processing" || found > 0 && processed >= found) {
+				return i
+			}
+			continue
+		}
+		if phasePatterns[phase].MatchString(line) {
+			return i
+		}
+	}
+	return d.current
+}
+
+// line feeds a log line printed at now
+func (d *phaseDetector) line(line string, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	next := d.detect(line)
+	if next == d.current {
+		return
+	}
+	from := ""
+	took := time.Duration(0)
+	if d.current >= 0 {
+		from = ipedPhases[d.current]
+		took = now.Sub(d.transitions[len(d.transitions)-1].Time)
+	}
+	d.current = next
+	d.transitions = append(d.transitions, phaseTransition{Phase: ipedPhases[next], Time: now})
+	if d.onChange != nil {
+		d.onChange(from, ipedPhases[next], now, took)
+	}
+}
+
+// finish ends the current phase at now
+func (d *phaseDetector) finish(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.current < 0 {
+		return
+	}
+	if d.onFinish != nil {
+		d.onFinish(ipedPhases[d.current], now.Sub(d.transitions[len(d.transitions)-1].Time))
+	}
+	d.current = len(ipedPhases)
+}
+
+// lineWriter calls f with every complete line written to it
+type lineWriter struct {
+	mu      sync.Mutex
+	pending []byte
+	f       func(string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = append(w.pending, p...)
+	for {
+		i := -1
+		for j, b := range w.pending {
+			if b == '\n' || b == '\r' {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			break
+		}
+		if i > 0 {
+			w.f(string(w.pending[:i]))
+		}
+		w.pending = w.pending[i+1:]
+	}
+	return len(p), nil
+}
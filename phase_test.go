@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPhaseDetector(t *testing.T) {
+	// IPED.log lines of a run, in the layout of its ProgressConsole lines,
+	// the messages do not matter
+	logLines := []string{
+		"2020-04-24 15:10:00\t[MSG]\t[indexer.datasource.SleuthkitReader]\t\t\t/data/mat1/image.E01",
+		"2020-04-24 15:10:01\t[INFO]\t[indexer.process.ItemProducer]\t\t\t/data/mat1/image.E01",
+		"2020-04-24 15:10:02\t[MSG]\t[indexer.datasource.SleuthkitReader]\t\t\t/data/mat1/image2.E01",
+		"2020-04-24 15:12:43     [MSG]   [indexer.process.ProgressConsole]                       Processando 2153/3591 (7%) 64GB/h Termino em 0h 55m 9s",
+		"2020-04-24 16:07:00     [MSG]   [indexer.process.ProgressConsole]                       Processando 3591/3591 (100%) 64GB/h",
+		"2020-04-24 16:07:01\t[INFO]\t[indexer.process.ItemProducer]\t\t\tlate line",
+		"2020-04-24 16:20:00\t[MSG]\t[indexer.process.task.HTMLReportTask]\t\t\t",
+	}
+	d := newPhaseDetector(newProgressParser(""))
+	type change struct {
+		from, to string
+		took     time.Duration
+	}
+	changes := []change{}
+	d.onChange = func(from, to string, at time.Time, took time.Duration) {
+		changes = append(changes, change{from, to, took})
+	}
+	var finished change
+	d.onFinish = func(phase string, took time.Duration) {
+		finished = change{from: phase, took: took}
+	}
+	start := time.Now()
+	for i, line := range logLines {
+		d.line(line, start.Add(time.Duration(i)*time.Minute))
+	}
+	d.finish(start.Add(10 * time.Minute))
+
+	expect := []change{
+		{"", "opening", 0},
+		{"opening", "enumerating", time.Minute},
+		{"enumerating", "processing", 2 * time.Minute},
+		{"processing", "committing", time.Minute},
+		{"committing", "reporting", 2 * time.Minute},
+	}
+	if !reflect.DeepEqual(changes, expect) {
+		t.Errorf("expected: %v, got: %v", expect, changes)
+	}
+	if finished.from != "reporting" || finished.took != 4*time.Minute {
+		t.Errorf("unexpected finish: %v", finished)
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	lines := []string{}
+	w := &lineWriter{f: func(line string) {
+		lines = append(lines, line)
+	}}
+	w.Write([]byte("first\nsec"))
+	w.Write([]byte("ond\r\nthird"))
+	w.Write([]byte("\n"))
+	expect := []string{"first", "second", "third"}
+	if strings.Join(lines, "|") != strings.Join(expect, "|") {
+		t.Errorf("expected: %v, got: %v", expect, lines)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// procState is the state letter of a process, like 'R', 'S' or 'Z'
+func procState(pid int) (byte, error) {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// the command name is in parentheses and may contain spaces
+	i := strings.LastIndexByte(string(stat), ')')
+	if i < 0 || i+2 >= len(stat) {
+		return 0, fmt.Errorf("unexpected /proc/%d/stat", pid)
+	}
+	return stat[i+2], nil
+}
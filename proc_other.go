@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// procState can not tell the process state, so it is assumed running
+func procState(pid int) (byte, error) {
+	return 'R', nil
+}
@@ -1,26 +1,236 @@
 package main
 
 import (
+	"bufio"
+	"os"
+	"path"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-func progress(ev event) (float64, float64, bool) {
-	progressRegexp := regexp.MustCompile("Processando ([0-9]+)/([0-9]+)")
-	if ev.Type == "progress" {
-		matches := progressRegexp.FindSubmatch([]byte(ev.Payload.Progress))
-		if len(matches) != 3 {
-			return 0, 0, false
+// progressWords are the words of the ProgressConsole messages of IPED's
+// locales (ProgressConsole.Processing and ProgressConsole.FinishIn of its
+// iped-engine-messages bundles), which start and end progress lines like
+// "Processando 2153/3591 (7%) 64GB/h Termino em 0h 55m 9s". Other locales
+// are matched by the logger of the line.
+var progressWords = map[string]struct{ processing, finishIn string }{
+	"en":    {"Processing", "Finish in"},
+	"pt-BR": {"Processando", "Termino em"},
+	"it-IT": {"Elaborazione", "Termine in"},
+	"de-DE": {"Verarbeitung", "Fertig in"},
+	"es-AR": {"Procesando", "Termina en"},
+	"fr-FR": {"Traitement", "Fin dans"},
+	"zh-CN": {"正在处理", "完成于"},
+}
+
+// progressCounters matches the counters, percentage and throughput of a
+// progress line
+const progressCounters = ` ([0-9]+)/([0-9]+)` +
+	`(?: \(([0-9]+)%\))?` +
+	`(?: ([0-9]+(?:[.,][0-9]+)?) ?([KMGT]?B)/h)?`
+
+// progressETA matches the time to finish after the words before it
+const progressETA = ` (?:([0-9]+)h ?)?(?:([0-9]+)m ?)?(?:([0-9]+)s)?`
+
+// progressTail matches the counters and time to finish of a line whose words
+// are not known
+const progressTail = progressCounters + `(?: [^0-9]+` + progressETA + `)?`
+
+// progressConsole matches the progress lines IPED.log gets from its
+// ProgressConsole logger, like
+// "2020-04-24 15:12:43	[MSG]	[indexer.process.ProgressConsole]	Processando ...",
+// whatever the locale
+var progressConsole = regexp.MustCompile(`\[[\w.]*ProgressConsole\]\s+[^0-9\s]+(?: [^0-9\s]+)*` + progressTail)
+
+var progressPatterns = compileProgressPatterns()
+
+func compileProgressPatterns() map[string]*regexp.Regexp {
+	patterns := map[string]*regexp.Regexp{}
+	for locale, words := range progressWords {
+		patterns[locale] = regexp.MustCompile(regexp.QuoteMeta(words.processing) + progressCounters +
+			`(?: ` + regexp.QuoteMeta(words.finishIn) + progressETA + `)?`)
+	}
+	return patterns
+}
+
+// progressStats is what a progress line tells about a running job
+type progressStats struct {
+	Processed    float64  `json:"processed"`
+	Found        float64  `json:"found"`
+	Percent      *float64 `json:"percent,omitempty"`
+	BytesPerHour *float64 `json:"bytesPerHour,omitempty"`
+	ETASeconds   *float64 `json:"etaSeconds,omitempty"`
+}
+
+// progressParser reads the counters of IPED progress lines
+type progressParser struct {
+	patterns []*regexp.Regexp
+}
+
+// newProgressParser returns a parser for the ProgressConsole lines and the
+// words of locale, or of every known locale if locale is empty or unknown
+func newProgressParser(locale string) progressParser {
+	if known := matchLocale(locale); known != "" {
+		return progressParser{patterns: []*regexp.Regexp{progressConsole, progressPatterns[known]}}
+	}
+	locales := make([]string, 0, len(progressPatterns))
+	for l := range progressPatterns {
+		locales = append(locales, l)
+	}
+	sort.Strings(locales)
+	parser := progressParser{patterns: []*regexp.Regexp{progressConsole}}
+	for _, l := range locales {
+		parser.patterns = append(parser.patterns, progressPatterns[l])
+	}
+	return parser
+}
+
+// matchLocale finds the known locale for names like "pt_BR", "pt-BR" or "pt"
+func matchLocale(locale string) string {
+	locale = strings.Replace(strings.TrimSpace(locale), "_", "-", -1)
+	if locale == "" {
+		return ""
+	}
+	for known := range progressWords {
+		if strings.EqualFold(known, locale) {
+			return known
+		}
+	}
+	lang := strings.SplitN(locale, "-", 2)[0]
+	for known := range progressWords {
+		if strings.EqualFold(strings.SplitN(known, "-", 2)[0], lang) {
+			return known
+		}
+	}
+	return ""
+}
+
+// ipedLocale is the locale IPED runs a profile with: the locale of the
+// LocalConfig.txt of the profile folder, which overrides the one next to
+// jar, where overwrite_profile.sh writes iped_locale. The profile folders of
+// a locale are profiles/<locale>/<profile>.
+func ipedLocale(jar, profile string) string {
+	dir := path.Dir(jar)
+	locale := configValue(path.Join(dir, "LocalConfig.txt"), "locale")
+	if profile != "" {
+		if own := configValue(path.Join(dir, "profiles", locale, profile, "LocalConfig.txt"), "locale"); own != "" {
+			locale = own
 		}
-		processed, err := strconv.Atoi(string(matches[1]))
+	}
+	return locale
+}
+
+// configValue is the value of key in an IPED config file, "" if it is not
+// set or the file cannot be read
+func configValue(file, key string) string {
+	f, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	value := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == key {
+			value = strings.TrimSpace(parts[1])
+		}
+	}
+	return value
+}
+
+func (p progressParser) parse(ev event) (float64, float64, bool) {
+	stats, ok := p.parseStats(ev)
+	return stats.Processed, stats.Found, ok
+}
+
+// parseStats reads the counters and, when present, the percentage,
+// throughput and estimated time to finish of a progress line
+func (p progressParser) parseStats(ev event) (progressStats, bool) {
+	if ev.Type != "progress" {
+		return progressStats{}, false
+	}
+	for _, progressRegexp := range p.patterns {
+		matches := progressRegexp.FindStringSubmatch(ev.Payload.Progress)
+		if len(matches) != 9 {
+			continue
+		}
+		processed, err := strconv.Atoi(matches[1])
 		if err != nil {
-			return 0, 0, false
+			return progressStats{}, false
 		}
-		found, err := strconv.Atoi(string(matches[2]))
+		found, err := strconv.Atoi(matches[2])
 		if err != nil {
-			return 0, 0, false
+			return progressStats{}, false
 		}
-		return float64(processed), float64(found), true
+		stats := progressStats{
+			Processed: float64(processed),
+			Found:     float64(found),
+		}
+		if matches[3] != "" {
+			percent, _ := strconv.ParseFloat(matches[3], 64)
+			stats.Percent = &percent
+		}
+		if matches[4] != "" {
+			size, err := parseBytes(strings.Replace(matches[4], ",", ".", 1) + matches[5])
+			if err == nil {
+				bytesPerHour := float64(size)
+				stats.BytesPerHour = &bytesPerHour
+			}
+		}
+		if matches[6] != "" || matches[7] != "" || matches[8] != "" {
+			h, _ := strconv.Atoi(matches[6])
+			m, _ := strconv.Atoi(matches[7])
+			sec, _ := strconv.Atoi(matches[8])
+			eta := float64(h*3600 + m*60 + sec)
+			stats.ETASeconds = &eta
+		}
+		return stats, true
+	}
+	return progressStats{}, false
+}
+
+// etaEstimator estimates the time to finish from the rate of processed
+// items, smoothed with an exponentially weighted moving average
+type etaEstimator struct {
+	mu        sync.Mutex
+	last      time.Time
+	processed float64
+	rate      float64
+}
+
+// etaSmoothing is the weight of the newest rate in the average
+const etaSmoothing = 0.2
+
+// update returns the seconds to process the remaining items, or false
+// while there is no rate yet
+func (e *etaEstimator) update(now time.Time, processed, found float64) (float64, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.last.IsZero() && now.After(e.last) && processed >= e.processed {
+		rate := (processed - e.processed) / now.Sub(e.last).Seconds()
+		if e.rate == 0 {
+			e.rate = rate
+		} else {
+			e.rate = etaSmoothing*rate + (1-etaSmoothing)*e.rate
+		}
+	}
+	e.last = now
+	e.processed = processed
+	if e.rate <= 0 {
+		return 0, false
+	}
+	remaining := found - processed
+	if remaining < 0 {
+		remaining = 0
 	}
-	return 0, 0, false
+	return remaining / e.rate, true
 }
@@ -1,6 +1,13 @@
 package main
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestProgress(t *testing.T) {
 	cases := []struct {
@@ -55,15 +62,182 @@ func TestProgress(t *testing.T) {
 		},
 	}
 	for _, c := range cases {
-		processed, found, ok := progress(c.input)
+		processed, found, ok := newProgressParser("pt-BR").parse(c.input)
 		if processed != c.expectProcessed {
-			t.Errorf("expected: %v, got %v, input: %x", c.expectProcessed, processed, c.input)
+			t.Errorf("expected: %v, got %v, input: %v", c.expectProcessed, processed, c.input)
 		}
 		if found != c.expectFound {
-			t.Errorf("expected: %v, got %v, input: %x", c.expectFound, found, c.input)
+			t.Errorf("expected: %v, got %v, input: %v", c.expectFound, found, c.input)
 		}
 		if ok != c.expectOk {
-			t.Errorf("expected: %v, got %v, input: %x", c.expectOk, ok, c.input)
+			t.Errorf("expected: %v, got %v, input: %v", c.expectOk, ok, c.input)
 		}
 	}
 }
+
+// progressSample is a progress line of a real IPED.log
+const progressSample = "2020-04-24 15:12:43     [MSG]   [indexer.process.ProgressConsole]                       Processando 2153/3591 (7%) 64GB/h Termino em 0h 55m 9s"
+
+func TestProgressLocales(t *testing.T) {
+	// ProgressConsole lines are read whatever the locale
+	ev := event{Type: "progress", Payload: eventPayload{Progress: progressSample}}
+	for _, locale := range []string{"pt-BR", "en", "fr-FR", ""} {
+		processed, found, ok := newProgressParser(locale).parse(ev)
+		if !ok || processed != 2153 || found != 3591 {
+			t.Errorf("%q: expected: 2153/3591, got: %v/%v %v", locale, processed, found, ok)
+		}
+	}
+	// lines without their logger need the words of the locale
+	cases := []struct {
+		locale string
+		line   string
+		expect bool
+	}{
+		{"pt-BR", "Processando 1/2", true},
+		{"en", "Processing 1/2", true},
+		{"", "Processing 1/2", true},
+		{"en", "Processando 1/2", false},
+		{"pt-BR", "Processing 1/2", false},
+		{"pt-BR", "[indexer.process.Manager] Processando 1/2", true},
+		{"pt-BR", "[indexer.process.Manager] Loaded 1/2", false},
+	}
+	for _, c := range cases {
+		_, _, ok := newProgressParser(c.locale).parse(event{Type: "progress", Payload: eventPayload{Progress: c.line}})
+		if ok != c.expect {
+			t.Errorf("%q %q: expected: %v, got: %v", c.locale, c.line, c.expect, ok)
+		}
+	}
+}
+
+// progressLines are progress lines of each locale as ProgressConsole logs
+// them: the pt-BR one is from a real IPED.log, the others have the words of
+// their locale's messages in the same line
+var progressLines = map[string]string{
+	"pt-BR": progressSample,
+	"en":    "2020-04-24 15:12:43     [MSG]   [indexer.process.ProgressConsole]                       Processing 2153/3591 (7%) 64GB/h Finish in 0h 55m 9s",
+	"it-IT": "2020-04-24 15:12:43     [MSG]   [indexer.process.ProgressConsole]                       Elaborazione 2153/3591 (7%) 64GB/h Termine in 0h 55m 9s",
+	"de-DE": "2020-04-24 15:12:43     [MSG]   [indexer.process.ProgressConsole]                       Verarbeitung 2153/3591 (7%) 64GB/h Fertig in 0h 55m 9s",
+	"es-AR": "2020-04-24 15:12:43     [MSG]   [indexer.process.ProgressConsole]                       Procesando 2153/3591 (7%) 64GB/h Termina en 0h 55m 9s",
+	"fr-FR": "2020-04-24 15:12:43     [MSG]   [indexer.process.ProgressConsole]                       Traitement 2153/3591 (7%) 64GB/h Fin dans 0h 55m 9s",
+	"zh-CN": "2020-04-24 15:12:43     [MSG]   [indexer.process.ProgressConsole]                       正在处理 2153/3591 (7%) 64GB/h 完成于 0h 55m 9s",
+}
+
+func TestProgressLocaleLines(t *testing.T) {
+	for locale := range progressWords {
+		line, ok := progressLines[locale]
+		if !ok {
+			t.Errorf("%s: no progress line", locale)
+			continue
+		}
+		// with and without its logger
+		for _, progress := range []string{line, line[strings.Index(line, "ProgressConsole]")+len("ProgressConsole]"):]} {
+			progress = strings.TrimSpace(progress)
+			stats, ok := newProgressParser(locale).parseStats(event{Type: "progress", Payload: eventPayload{Progress: progress}})
+			if !ok || stats.Processed != 2153 || stats.Found != 3591 {
+				t.Errorf("%s %q: expected: 2153/3591, got: %+v %v", locale, progress, stats, ok)
+				continue
+			}
+			if stats.Percent == nil || *stats.Percent != 7 || stats.BytesPerHour == nil || *stats.BytesPerHour != 64<<30 ||
+				stats.ETASeconds == nil || *stats.ETASeconds != 55*60+9 {
+				t.Errorf("%s %q: unexpected stats: %+v", locale, progress, stats)
+			}
+		}
+	}
+}
+
+func TestMatchLocale(t *testing.T) {
+	cases := map[string]string{
+		"pt-BR": "pt-BR",
+		"pt_BR": "pt-BR",
+		"pt":    "pt-BR",
+		"en":    "en",
+		"en-US": "en",
+		"it_IT": "it-IT",
+		"de":    "de-DE",
+		"es-ES": "es-AR",
+		"fr-FR": "fr-FR",
+		"zh-CN": "zh-CN",
+		"xx":    "",
+		"":      "",
+	}
+	for input, expect := range cases {
+		if got := matchLocale(input); got != expect {
+			t.Errorf("%q: expected: %q, got: %q", input, expect, got)
+		}
+	}
+}
+
+func TestIpedLocale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := "# Locale of the messages\n#locale = pt-BR\nlocale = en\n"
+	ioutil.WriteFile(path.Join(dir, "LocalConfig.txt"), []byte(config), 0644)
+	os.MkdirAll(path.Join(dir, "profiles", "en", "forensic"), 0755)
+	os.MkdirAll(path.Join(dir, "profiles", "en", "fastmode"), 0755)
+	ioutil.WriteFile(path.Join(dir, "profiles", "en", "fastmode", "LocalConfig.txt"), []byte("locale = pt-BR\n"), 0644)
+	jar := path.Join(dir, "iped.jar")
+
+	cases := map[string]string{
+		"":         "en",
+		"forensic": "en",
+		"fastmode": "pt-BR",
+		"missing":  "en",
+	}
+	for profile, expect := range cases {
+		if got := ipedLocale(jar, profile); got != expect {
+			t.Errorf("profile %q: expected: %q, got: %q", profile, expect, got)
+		}
+	}
+}
+
+func TestProgressStats(t *testing.T) {
+	stats, ok := newProgressParser("").parseStats(event{Type: "progress", Payload: eventPayload{Progress: progressSample}})
+	if !ok {
+		t.Fatal("expected a match")
+	}
+	if stats.Percent == nil || *stats.Percent != 7 {
+		t.Errorf("expected: 7%%, got: %v", stats.Percent)
+	}
+	if stats.BytesPerHour == nil || *stats.BytesPerHour != 64<<30 {
+		t.Errorf("expected: 64GB/h, got: %v", stats.BytesPerHour)
+	}
+	if stats.ETASeconds == nil || *stats.ETASeconds != 55*60+9 {
+		t.Errorf("expected: 3309s, got: %v", stats.ETASeconds)
+	}
+
+	stats, ok = newProgressParser("en").parseStats(event{Type: "progress", Payload: eventPayload{Progress: "Processing 10/20"}})
+	if !ok || stats.Processed != 10 || stats.Found != 20 {
+		t.Errorf("unexpected stats: %+v %v", stats, ok)
+	}
+	if stats.Percent != nil || stats.BytesPerHour != nil || stats.ETASeconds != nil {
+		t.Errorf("expected only counters, got: %+v", stats)
+	}
+
+	stats, _ = newProgressParser("pt-BR").parseStats(event{Type: "progress", Payload: eventPayload{Progress: "Processando 10/20 (50%) 1,5GB/h Termino em 2m 3s"}})
+	if stats.BytesPerHour == nil || *stats.BytesPerHour != 3<<29 {
+		t.Errorf("expected: 1.5GB/h, got: %v", stats.BytesPerHour)
+	}
+	if stats.ETASeconds == nil || *stats.ETASeconds != 123 {
+		t.Errorf("expected: 123s, got: %v", stats.ETASeconds)
+	}
+}
+
+func TestEtaEstimator(t *testing.T) {
+	e := etaEstimator{}
+	start := time.Now()
+	if _, ok := e.update(start, 0, 1000); ok {
+		t.Error("expected no estimate without a rate")
+	}
+	eta, ok := e.update(start.Add(10*time.Second), 100, 1000)
+	if !ok || eta != 90 {
+		t.Errorf("expected: 90s, got: %v %v", eta, ok)
+	}
+	// a faster rate moves the estimate only partially
+	eta, _ = e.update(start.Add(20*time.Second), 300, 1000)
+	if eta <= 700.0/20 || eta >= 70 {
+		t.Errorf("expected a smoothed estimate between 35s and 70s, got: %v", eta)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// pusher pushes a metrics registry to a Prometheus Pushgateway, for workers
+// that exit before being scraped
+type pusher struct {
+	URL      string
+	Job      string
+	Grouping [][2]string
+	Gatherer prometheus.Gatherer
+	client   *http.Client
+}
+
+// newPusher groups the metrics by the worker host and, in single job mode,
+// by run, the job id. The grouping labels must not be labels of the pushed
+// metrics, so it is not job_id.
+func newPusher(URL, job, jobID string) *pusher {
+	hostname, _ := os.Hostname()
+	grouping := [][2]string{{"instance", hostname}}
+	if jobID != "" {
+		grouping = append(grouping, [2]string{"run", jobID})
+	}
+	return &pusher{
+		URL:      strings.TrimRight(URL, "/"),
+		Job:      job,
+		Grouping: grouping,
+		Gatherer: prometheus.DefaultGatherer,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// push replaces the metrics of the grouping key with the current ones
+func (p *pusher) push() error {
+	pusher := push.New(p.URL, p.Job).Gatherer(p.Gatherer).Client(p.client)
+	for _, kv := range p.Grouping {
+		pusher = pusher.Grouping(kv[0], kv[1])
+	}
+	return pusher.Push()
+}
+
+// pushEvery pushes the metrics periodically until ctx is done
+func (p *pusher) pushEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := p.push()
+			if err != nil {
+				logger.Warn("could not push metrics", "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPusher(t *testing.T) {
+	var method, path, body string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.EscapedPath()
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+	}))
+	defer gateway.Close()
+
+	// the per-job metrics of a running job, as the worker pushes them
+	params := ipedParams{id: "push1", evidence: "/data/mat1/image.E01", profile: "forensic"}
+	testMetrics.jobStarted(params)
+	testMetrics.processed.WithLabelValues(params.id).Set(10)
+	testMetrics.phase.WithLabelValues(params.id, "processing").Set(1)
+	defer testMetrics.forgetJob(params)
+
+	p := newPusher(gateway.URL+"/", "ipedworker", "push1")
+	p.Grouping[0][1] = "worker-1"
+	err := p.push()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method != http.MethodPut {
+		t.Errorf("expected: PUT, got: %v", method)
+	}
+	if !samePushPath(path, "/metrics/job/ipedworker/instance/worker-1/run/push1") {
+		t.Errorf("unexpected path: %v", path)
+	}
+	// the body is in the protobuf format, label values are readable in it
+	for _, expect := range []string{"ipedworker_runIped_processed", "job_id", "push1", "ipedworker_job_info"} {
+		if !strings.Contains(body, expect) {
+			t.Errorf("expected %q in the pushed metrics", expect)
+		}
+	}
+
+	p.Grouping[1][1] = "cases/123"
+	err = p.push()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !samePushPath(path, "/metrics/job/ipedworker/instance/worker-1/run@base64/Y2FzZXMvMTIz") {
+		t.Errorf("unexpected path: %v", path)
+	}
+}
+
+// samePushPath compares Pushgateway paths, the grouping labels come in any
+// order
+func samePushPath(got, expected string) bool {
+	pairs := func(p string) []string {
+		parts := strings.Split(strings.TrimPrefix(p, "/metrics/"), "/")
+		if len(parts)%2 != 0 {
+			return nil
+		}
+		var kv []string
+		for i := 0; i < len(parts); i += 2 {
+			kv = append(kv, parts[i]+"="+parts[i+1])
+		}
+		sort.Strings(kv[1:])
+		return kv
+	}
+	g, e := pairs(got), pairs(expected)
+	return g != nil && strings.Join(g, "/") == strings.Join(e, "/")
+}
+
+func TestPusherError(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad", http.StatusBadRequest)
+	}))
+	defer gateway.Close()
+	p := newPusher(gateway.URL, "ipedworker", "")
+	p.Gatherer = prometheus.NewRegistry()
+	if err := p.push(); err == nil {
+		t.Error("expected error")
+	}
+}
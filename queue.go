@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fairShare orders the jobs a worker holds: by priority, raised by one for
+// each aging interval a job waits so low priorities are not starved, then by
+// requester, preferring the ones with fewer running jobs and, among those,
+// the one served least recently, then by submission time.
+type fairShare struct {
+	mu        sync.Mutex
+	aging     time.Duration
+	running   map[string]int
+	lastStart map[string]time.Time
+}
+
+func newFairShare(aging time.Duration) *fairShare {
+	return &fairShare{
+		aging:     aging,
+		running:   map[string]int{},
+		lastStart: map[string]time.Time{},
+	}
+}
+
+// priority is the priority of a job after aging
+func (f *fairShare) priority(job Job, now time.Time) int {
+	if f.aging <= 0 || job.SubmittedAt.IsZero() || now.Before(job.SubmittedAt) {
+		return job.Priority
+	}
+	return job.Priority + int(now.Sub(job.SubmittedAt)/f.aging)
+}
+
+// sort orders jobs, the first one runs next
+func (f *fairShare) sort(jobs []Job, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sort.SliceStable(jobs, func(a, b int) bool {
+		ja, jb := jobs[a], jobs[b]
+		if pa, pb := f.priority(ja, now), f.priority(jb, now); pa != pb {
+			return pa > pb
+		}
+		if ra, rb := f.running[ja.Requester], f.running[jb.Requester]; ra != rb {
+			return ra < rb
+		}
+		if la, lb := f.lastStart[ja.Requester], f.lastStart[jb.Requester]; !la.Equal(lb) {
+			return la.Before(lb)
+		}
+		return ja.SubmittedAt.Before(jb.SubmittedAt)
+	})
+}
+
+// started counts a running job of requester
+func (f *fairShare) started(requester string, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.running[requester]++
+	f.lastStart[requester] = now
+}
+
+func (f *fairShare) finished(requester string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.running[requester]--
+	if f.running[requester] <= 0 {
+		delete(f.running, requester)
+	}
+}
+
+// queueEntry is a waiting job in GET /queue
+type queueEntry struct {
+	Position       int        `json:"position"`
+	ID             string     `json:"id"`
+	EvidencePath   string     `json:"evidencePath"`
+	Requester      string     `json:"requester,omitempty"`
+	Priority       int        `json:"priority"`
+	Effective      int        `json:"effectivePriority"`
+	SubmittedAt    time.Time  `json:"submittedAt"`
+	EstimatedStart *time.Time `json:"estimatedStart,omitempty"`
+}
+
+type queueReport struct {
+	Jobs []queueEntry `json:"jobs"`
+	// AverageDuration is the mean duration of the jobs done so far, in
+	// seconds, the estimates are based on it
+	AverageDuration float64 `json:"averageDurationSeconds,omitempty"`
+}
+
+// averageJobDuration is the mean of ipedworker_job_duration_seconds for the
+// jobs that were done, false if none was
+func averageJobDuration(gatherer prometheus.Gatherer) (time.Duration, bool) {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return 0, false
+	}
+	var sum float64
+	var count uint64
+	for _, family := range families {
+		if family.GetName() != "ipedworker_job_duration_seconds" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			done := false
+			for _, label := range m.GetLabel() {
+				done = done || (label.GetName() == "result" && label.GetValue() == "done")
+			}
+			if done {
+				sum += m.GetHistogram().GetSampleSum()
+				count += m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	if count == 0 {
+		return 0, false
+	}
+	return time.Duration(sum / float64(count) * float64(time.Second)), true
+}
+
+// estimateStarts tells when each of n queued jobs would start if every job
+// took average and ran in the first free slot. Jobs running longer than
+// average are expected to end now. CPU and memory budgets are not taken into
+// account.
+func estimateStarts(running []jobStatus, slots int, average time.Duration, n int, now time.Time) []time.Time {
+	if slots < 1 {
+		slots = 1
+	}
+	free := make([]time.Time, slots)
+	for i := range free {
+		free[i] = now
+	}
+	for i, job := range running {
+		if i >= slots {
+			break
+		}
+		end := job.StartTime.Add(average)
+		if end.After(now) {
+			free[i] = end
+		}
+	}
+	starts := make([]time.Time, n)
+	for i := range starts {
+		next := 0
+		for s := range free {
+			if free[s].Before(free[next]) {
+				next = s
+			}
+		}
+		starts[i] = free[next]
+		free[next] = free[next].Add(average)
+	}
+	return starts
+}
+
+// queueHandler lists the jobs waiting in s in the order they will run
+func (s *httpSource) queueHandler(state *workerState, scheduler *slotScheduler) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		now := time.Now()
+		jobs := s.ordered(now)
+		report := queueReport{Jobs: make([]queueEntry, len(jobs))}
+		average, known := averageJobDuration(prometheus.DefaultGatherer)
+		var starts []time.Time
+		if known {
+			report.AverageDuration = average.Seconds()
+			running, _ := state.snapshot()
+			starts = estimateStarts(running, scheduler.capacity().Slots, average, len(jobs), now)
+		}
+		for i, job := range jobs {
+			report.Jobs[i] = queueEntry{
+				Position:     i + 1,
+				ID:           job.ID,
+				EvidencePath: job.EvidencePath,
+				Requester:    job.Requester,
+				Priority:     job.Priority,
+				Effective:    s.share.priority(job, now),
+				SubmittedAt:  job.SubmittedAt,
+			}
+			if known {
+				report.Jobs[i].EstimatedStart = &starts[i]
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestFairShare(t *testing.T) {
+	now := time.Now()
+	f := newFairShare(time.Hour)
+	jobs := []Job{
+		{ID: "a1", Requester: "a", SubmittedAt: now.Add(-3 * time.Minute)},
+		{ID: "a2", Requester: "a", SubmittedAt: now.Add(-2 * time.Minute)},
+		{ID: "b1", Requester: "b", SubmittedAt: now.Add(-1 * time.Minute)},
+		{ID: "urgent", Requester: "c", Priority: 2, SubmittedAt: now},
+		{ID: "old", Requester: "d", Priority: -1, SubmittedAt: now.Add(-150 * time.Minute)},
+	}
+	order := func() []string {
+		f.sort(jobs, now)
+		ids := []string{}
+		for _, job := range jobs {
+			ids = append(ids, job.ID)
+		}
+		return ids
+	}
+	// old waited two hours, its priority is 1
+	expected := []string{"urgent", "old", "a1", "a2", "b1"}
+	if got := order(); !equalStrings(got, expected) {
+		t.Errorf("expected %v, got: %v", expected, got)
+	}
+
+	// a is running a job, b goes first
+	f.started("a", now)
+	expected = []string{"urgent", "old", "b1", "a1", "a2"}
+	if got := order(); !equalStrings(got, expected) {
+		t.Errorf("expected %v, got: %v", expected, got)
+	}
+
+	// a finished but was served more recently than b
+	f.finished("a")
+	expected = []string{"urgent", "old", "b1", "a1", "a2"}
+	if got := order(); !equalStrings(got, expected) {
+		t.Errorf("expected %v, got: %v", expected, got)
+	}
+	f.started("b", now.Add(time.Second))
+	f.finished("b")
+	expected = []string{"urgent", "old", "a1", "a2", "b1"}
+	if got := order(); !equalStrings(got, expected) {
+		t.Errorf("expected %v, got: %v", expected, got)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestEstimateStarts(t *testing.T) {
+	now := time.Now()
+	running := []jobStatus{
+		{StartTime: now.Add(-30 * time.Minute)},
+		// running longer than average
+		{StartTime: now.Add(-3 * time.Hour)},
+	}
+	starts := estimateStarts(running, 2, time.Hour, 3, now)
+	expected := []time.Time{now, now.Add(30 * time.Minute), now.Add(time.Hour)}
+	for i := range expected {
+		if !starts[i].Equal(expected[i]) {
+			t.Errorf("job %d: expected to start in %s, got: %s", i, expected[i].Sub(now), starts[i].Sub(now))
+		}
+	}
+}
+
+func TestAverageJobDuration(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	if _, ok := averageJobDuration(registry); ok {
+		t.Error("expected no average without jobs")
+	}
+	h := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "ipedworker_job_duration_seconds",
+	}, []string{"result"})
+	registry.MustRegister(h)
+	h.WithLabelValues("done").Observe(60)
+	h.WithLabelValues("done").Observe(180)
+	h.WithLabelValues("failed").Observe(1)
+	if average, ok := averageJobDuration(registry); !ok || average != 2*time.Minute {
+		t.Errorf("expected 2m, got: %s %v", average, ok)
+	}
+}
+
+func TestQueueHandler(t *testing.T) {
+	s := newHTTPSource(Job{}, time.Hour)
+	s.submit(Job{ID: "a", EvidencePath: "/data/a.E01"})
+	s.submit(Job{ID: "b", EvidencePath: "/data/b.E01", Priority: 1})
+	w := httptest.NewRecorder()
+	scheduler := newSlotScheduler("", 1, jobResources{}, jobResources{})
+	s.queueHandler(newWorkerState("", ""), scheduler)(w, httptest.NewRequest("GET", "/queue", nil))
+	var report queueReport
+	err := json.NewDecoder(w.Body).Decode(&report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Jobs) != 2 || report.Jobs[0].ID != "b" || report.Jobs[1].Position != 2 {
+		t.Errorf("unexpected queue: %+v", report.Jobs)
+	}
+}
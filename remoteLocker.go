@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"sync"
 )
 
@@ -10,7 +11,7 @@ type remoteLocker struct {
 	EvidencePath string
 }
 
-func (l *remoteLocker) Lock(evidencePath string) error {
+func (l *remoteLocker) Lock(ctx context.Context, evidencePath string) error {
 	l.Locker.Lock()
 	l.EvidencePath = evidencePath
 	body := event{
@@ -19,7 +20,7 @@ func (l *remoteLocker) Lock(evidencePath string) error {
 			EvidencePath: l.EvidencePath,
 		},
 	}
-	err := sendEvent(l.URL, body)
+	err := sendEvent(ctx, l.URL, body)
 	if err != nil {
 		l.EvidencePath = ""
 		l.Locker.Unlock()
@@ -27,7 +28,7 @@ func (l *remoteLocker) Lock(evidencePath string) error {
 	return err
 }
 
-func (l *remoteLocker) Unlock() error {
+func (l *remoteLocker) Unlock(ctx context.Context) error {
 	defer func() {
 		l.EvidencePath = ""
 		l.Locker.Unlock()
@@ -38,5 +39,5 @@ func (l *remoteLocker) Unlock() error {
 			EvidencePath: l.EvidencePath,
 		},
 	}
-	return sendEvent(l.URL, body)
+	return sendEvent(ctx, l.URL, body)
 }
@@ -1,147 +1,484 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"os/exec"
 	"path"
 	"strings"
+	"sync"
 	"time"
 )
 
 type ipedParams struct {
+	id              string
 	jar             string
 	evidence        string
 	output          string
 	profile         string
 	additionalArgs  string
 	additionalPaths string
+	mvPath          string
+	perms           permPolicy
+	runAs           credential
+	jobRunAs        string
+	maxHeap         string
+	status          *jobStatus
+	progress        progressParser
+	logRotation     logRotation
+	audit           *auditLog
+	// attempt counts the runs of the job, starting at 1
+	attempt int
 }
 
-func runIped(params ipedParams, locker *remoteLocker, notifierURL string, metrics ipedMetrics) (finalError error) {
-	hostname, _ := os.Hostname()
-	metrics.calls.WithLabelValues(hostname, params.evidence).Inc()
-	metrics.running.WithLabelValues(hostname, params.evidence).Set(0)
+// jobError is a job failure with the step that failed. Transient failures,
+// like a service being down before IPED started, can be retried.
+type jobError struct {
+	reason    string
+	err       error
+	transient bool
+}
+
+func (e jobError) Error() string {
+	return e.err.Error()
+}
+
+// failure tags err with the step that failed, nil stays nil
+func failure(reason string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return jobError{reason: reason, err: err}
+}
+
+// transientFailure is a failure worth retrying, nil stays nil
+func transientFailure(reason string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return jobError{reason: reason, err: err, transient: true}
+}
+
+func isTransient(err error) bool {
+	jerr, ok := err.(jobError)
+	return ok && jerr.transient
+}
+
+func failureReason(err error) string {
+	if err == nil {
+		return ""
+	}
+	if jerr, ok := err.(jobError); ok {
+		return jerr.reason
+	}
+	return "unknown"
+}
+
+func runIped(ctx context.Context, params ipedParams, locker *remoteLocker, notifierURL string, metrics ipedMetrics) (finalError error) {
+	ctx, jobSpan := startSpan(ctx, "job")
+	jobSpan.setAttribute("job.id", params.id)
+	jobSpan.setAttribute("job.evidence", params.evidence)
+	jobSpan.setAttribute("job.profile", params.profile)
+	loggerFrom(ctx).Info("job started", "profile", params.profile)
+	timings := newJobTimings(time.Now())
+	metrics.calls.WithLabelValues(metrics.labelValues(params)...).Inc()
+	metrics.jobStarted(params)
+	metrics.jobStart.WithLabelValues(params.id).Set(float64(timings.start.UnixNano()) / 1e9)
+	defer func() {
+		result := "done"
+		if finalError != nil {
+			result = "failed"
+		}
+		metrics.finish.WithLabelValues(metrics.labelValues(params, result, failureReason(finalError))...).Inc()
+		metrics.observeTimings(params, timings, time.Now(), result)
+		metrics.jobFinished(params)
+		loggerFrom(ctx).Info("job finished", "result", result, "reason", failureReason(finalError))
+		jobSpan.setAttribute("job.result", result)
+		jobSpan.finish(finalError)
+	}()
+
+	params.status.setPhase(phaseValidating)
+	_, sp := startSpan(ctx, "validate")
+	err := validateParams(params)
+	sp.finish(err)
+	if err != nil {
+		return failure("validation", err)
+	}
+
+	size, err := evidenceSize(params)
+	if err != nil {
+		loggerFrom(ctx).Warn("could not compute the evidence size", "err", err)
+	} else {
+		metrics.evidenceBytes.WithLabelValues(params.id).Set(float64(size))
+	}
 
-	return withLocker(params, locker, metrics, func() error {
-		logWriter, err := makeLogWriter(params, notifierURL, metrics)
+	lockStart := time.Now()
+	return withLocker(ctx, &params, locker, func() error {
+		timings.lockWait = time.Since(lockStart)
+		params.status.setPhase(phaseLocked)
+		cred, err := resolveCredential(params.runAs, params.jobRunAs, params)
 		if err != nil {
-			return err
+			return failure("setup", err)
 		}
+		params.runAs = cred
+		params.audit.log("config", map[string]string{
+			"profile":        params.profile,
+			"additionalArgs": params.additionalArgs,
+			"maxHeap":        params.maxHeap,
+			"runAs":          fmt.Sprintf("%d:%d", cred.UID, cred.GID),
+			"groups":         fmt.Sprint(cred.Groups),
+			"mvPath":         params.mvPath,
+		})
 
+		_, sp := startSpan(ctx, "makeIpedFolder")
 		ipedfolder, err := makeIpedFolder(params)
+		sp.finish(err)
+		if err != nil {
+			return failure("setup", err)
+		}
+		params.status.setCaseFolder(ipedfolder)
+		params.audit.log("mkdir", map[string]string{
+			"path":  ipedfolder,
+			"mode":  fmt.Sprintf("%04o", params.perms.RunningMode),
+			"owner": fmt.Sprintf("%d:%d", cred.UID, cred.GID),
+		})
+
+		logWriter, stopLog, err := makeLogWriter(ctx, params, ipedfolder, notifierURL, metrics)
 		if err != nil {
-			return err
+			return failure("setup", err)
 		}
+		defer stopLog()
 
-		err = sendEvent(notifierURL, event{
+		err = sendEvent(ctx, notifierURL, event{
 			Type: "running",
 			Payload: eventPayload{
 				EvidencePath: params.evidence,
 			},
 		})
 		if err != nil {
-			return fmt.Errorf("could not set status to 'running': %v", err)
+			return transientFailure("notifier", fmt.Errorf("could not set status to 'running': %v", err))
 		}
 
-		errCmd := coreRun(params, logWriter)
+		params.status.setPhase(phaseRunning)
+		running := metrics.running.WithLabelValues(metrics.labelValues(params)...)
+		running.Inc()
+		ipedStart := time.Now()
+		_, sp = startSpan(ctx, "coreRun")
+		errCmd := failure("iped", coreRun(params, logWriter))
+		sp.finish(errCmd)
+		timings.iped = time.Since(ipedStart)
+		running.Dec()
+		// the log is complete, with its segments compressed, before the
+		// case folder is changed
+		stopLog()
+		hashes, err := fileHashes(ipedfolder, logName, logIndexName, "IPED.attempt*.log*")
+		if err != nil {
+			loggerFrom(ctx).Warn("could not hash the logs", "err", err)
+		} else {
+			params.audit.log("hash", hashes)
+		}
+
+		var perms *permCounts
+		if errCmd == nil {
+			params.status.setPhase(phasePostProcessing)
+			postStart := time.Now()
+			var report permReport
+			_, sp = startSpan(ctx, "postActions")
+			report, err = postActions(ipedfolder, params.perms)
+			sp.finish(err)
+			counts := report.counts()
+			params.audit.log("permissions", map[string]string{
+				"path":    ipedfolder,
+				"mode":    fmt.Sprintf("%04o", params.perms.DoneMode),
+				"owner":   fmt.Sprintf("%d:%d", params.perms.UID, params.perms.GID),
+				"acl":     fmt.Sprint(params.perms.ACL),
+				"changed": fmt.Sprint(counts.Changed),
+				"missing": fmt.Sprint(counts.Missing),
+				"failed":  fmt.Sprint(counts.Failed),
+			})
+			timings.postActions = time.Since(postStart)
+			errCmd = failure("post-actions", err)
+			perms = counts
+		}
+
+		var outputSize int64
+		var gbPerHour float64
+		if errCmd == nil {
+			outputSize, err = pathSize(ipedfolder)
+			if err != nil {
+				loggerFrom(ctx).Warn("could not compute the output size", "err", err)
+			} else {
+				metrics.outputBytes.WithLabelValues(params.id).Set(float64(outputSize))
+			}
+			if size > 0 && timings.iped > 0 {
+				gbPerHour = float64(size) / (1 << 30) / timings.iped.Hours()
+			}
+		}
+
+		if errCmd == nil && params.mvPath != "" {
+			params.status.setPhase(phaseMoving)
+			moveStart := time.Now()
+			_, sp = startSpan(ctx, "move")
+			sp.setAttribute("move.destination", params.mvPath)
+			moved, err := moveCase(ipedfolder, params.mvPath)
+			sp.finish(err)
+			timings.move = time.Since(moveStart)
+			errCmd = failure("move", err)
+			if errCmd == nil {
+				params.audit.log("move", map[string]string{"from": ipedfolder, "to": moved})
+				ipedfolder = moved
+				params.status.setCaseFolder(ipedfolder)
+				err = params.audit.moveNextTo(ipedfolder)
+				if err != nil {
+					loggerFrom(ctx).Error("could not move the audit log", "err", err)
+				}
+			}
+		}
 
 		finalStatus := "done"
 		if errCmd != nil {
 			finalStatus = "failed"
+		} else {
+			params.audit.log("done", map[string]string{"path": ipedfolder})
 		}
-		err = sendEvent(notifierURL, event{
+		err = sendEvent(ctx, notifierURL, event{
 			Type: finalStatus,
 			Payload: eventPayload{
 				EvidencePath: params.evidence,
+				OutputPath:   ipedfolder,
+				Permissions:  perms,
+
+				EvidenceBytes: size,
+				OutputBytes:   outputSize,
+				GBPerHour:     gbPerHour,
+				AuditHead:     params.audit.head(),
 			},
 		})
 		if err != nil {
-			return fmt.Errorf("could not set status to '%s': %v", finalStatus, err)
+			return failure("notifier", fmt.Errorf("could not set status to '%s': %v", finalStatus, err))
 		}
+		return errCmd
+	})
+}
 
-		if errCmd != nil {
-			return err
+// validateParams checks the job before taking the lock
+func validateParams(params ipedParams) error {
+	if params.output == "" {
+		return fmt.Errorf("invalid job: output path not set")
+	}
+	_, err := os.Stat(params.jar)
+	if err != nil {
+		return fmt.Errorf("invalid IPED jar: %v", err)
+	}
+	_, err = os.Stat(params.evidence)
+	if err != nil {
+		return fmt.Errorf("invalid evidence: %v", err)
+	}
+	for _, p := range additionalPaths(params) {
+		if !path.IsAbs(p) {
+			p = path.Join(path.Dir(params.evidence), p)
 		}
-
-		err = postActions(ipedfolder)
-		return err
-	})
+		_, err = os.Stat(p)
+		if err != nil {
+			return fmt.Errorf("invalid additional path: %v", err)
+		}
+	}
+	return nil
 }
 
-func withLocker(params ipedParams, locker *remoteLocker, metrics ipedMetrics, f func() error) (finalError error) {
-	hostname, _ := os.Hostname()
-	err := locker.Lock(params.evidence)
+// withLocker runs f holding the lock of the evidence. The audit log of the
+// case is only written while the lock is held, a worker that could not lock
+// writes nothing to it and the outcome of f is recorded before unlocking, as
+// the next holder continues the chain.
+func withLocker(ctx context.Context, params *ipedParams, locker *remoteLocker, f func() error) (finalError error) {
+	lockCtx, sp := startSpan(ctx, "lock")
+	err := locker.Lock(lockCtx, params.evidence)
+	sp.finish(err)
 	if err != nil {
-		return err
+		// the case belongs to whoever holds the lock, its audit log too
+		return transientFailure("lock", err)
 	}
 	defer func() {
-		result := "done"
 		if finalError != nil {
-			result = "failed"
+			params.audit.log("failed", map[string]string{"reason": failureReason(finalError), "error": finalError.Error()})
 		}
-		metrics.running.WithLabelValues(hostname, params.evidence).Set(0)
-		metrics.finish.WithLabelValues(hostname, params.evidence, result).Inc()
-		err := locker.Unlock()
+		params.audit.log("unlock", map[string]string{"evidence": params.evidence})
+		err := locker.Unlock(ctx)
 		if err != nil {
-			finalError = err
+			// the log may already belong to the next holder
+			loggerFrom(ctx).Error("could not unlock the evidence", "evidence", params.evidence, "err", err)
+			if finalError == nil {
+				finalError = failure("unlock", err)
+			}
 		}
 	}()
+	params.audit, err = openAuditLog(auditPath(caseFolder(*params)), params.id, params.attempt)
+	if err != nil {
+		return failure("setup", err)
+	}
+	params.audit.log("start", map[string]string{
+		"evidence":        params.evidence,
+		"output":          caseFolder(*params),
+		"additionalPaths": params.additionalPaths,
+	})
+	params.audit.log("lock", map[string]string{"evidence": params.evidence})
 	return f()
 }
 
-func makeLogWriter(params ipedParams, notifierURL string, metrics ipedMetrics) (io.Writer, error) {
+// makeLogWriter returns the writer for IPED output and a function that
+// stops its event goroutines and closes the log, which can be called again
+func makeLogWriter(ctx context.Context, params ipedParams, ipedfolder string, notifierURL string, metrics ipedMetrics) (io.Writer, func(), error) {
 	hostname, err := os.Hostname()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+
+	log, err := openRotatingLog(ipedfolder, params.attempt, params.logRotation)
+	if err != nil {
+		return nil, nil, err
+	}
+	params.status.setLogPath(path.Join(ipedfolder, logName))
+	fmt.Fprintf(log, "HOSTNAME: %s\n", hostname)
+
 	events := make(chan event)
-	go eventThrottle(events, func(ev event) {
-		processed, found, ok := progress(ev)
+	done := make(chan struct{})
+	eta := &etaEstimator{}
+	go eventThrottle(events, done, "eventThrottle/"+params.id, func(ev event) {
+		stats, ok := params.progress.parseStats(ev)
 		if ok {
-			metrics.processed.WithLabelValues(hostname, params.evidence).Set(processed)
-			metrics.found.WithLabelValues(hostname, params.evidence).Set(found)
+			seconds, estimated := eta.update(time.Now(), stats.Processed, stats.Found)
+			if stats.ETASeconds == nil && estimated {
+				stats.ETASeconds = &seconds
+			}
+			params.status.progress(stats.Processed, stats.Found)
+			metrics.processed.WithLabelValues(params.id).Set(stats.Processed)
+			metrics.found.WithLabelValues(params.id).Set(stats.Found)
+			if stats.Percent != nil {
+				metrics.percent.WithLabelValues(params.id).Set(*stats.Percent)
+			}
+			if stats.BytesPerHour != nil {
+				metrics.throughput.WithLabelValues(params.id).Set(*stats.BytesPerHour)
+			}
+			if stats.ETASeconds != nil {
+				metrics.eta.WithLabelValues(params.id).Set(*stats.ETASeconds)
+			}
+			ev.Payload.Stats = &stats
 		}
-		sendEvent(notifierURL, ev)
+		sendEvent(ctx, notifierURL, ev)
 	})
 
-	ipedfolder, err := makeIpedFolder(params)
-	if err != nil {
-		return nil, err
+	phases := newPhaseDetector(params.progress)
+	phases.onChange = func(from, to string, at time.Time, took time.Duration) {
+		if from != "" {
+			metrics.phase.WithLabelValues(params.id, from).Set(0)
+			metrics.phaseDuration.WithLabelValues(from).Observe(took.Seconds())
+		}
+		metrics.phase.WithLabelValues(params.id, to).Set(1)
+		params.status.setIpedPhase(to, at)
+		ev := event{
+			Type: "phase",
+			Payload: eventPayload{
+				EvidencePath: params.evidence,
+				Phase:        to,
+			},
+		}
+		go func() {
+			select {
+			case events <- ev:
+			case <-done:
+			}
+		}()
 	}
-
-	log, err := os.OpenFile(path.Join(ipedfolder, "IPED.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return nil, err
+	phases.onFinish = func(phase string, took time.Duration) {
+		metrics.phase.WithLabelValues(params.id, phase).Set(0)
+		metrics.phaseDuration.WithLabelValues(phase).Observe(took.Seconds())
 	}
-	log.WriteString(fmt.Sprintf("HOSTNAME: %s\n", hostname))
+
 	dw := doubleWriter{
-		Writer1: os.Stdout,
-		Writer2: log,
+		Writer1: doubleWriter{
+			Writer1: ipedLogWriter(ctx, loggerFrom(ctx)),
+			Writer2: log,
+		},
+		Writer2: &lineWriter{f: func(line string) {
+			phases.line(line, time.Now())
+		}},
 	}
 	eWriter := eventWriter{
 		EvidencePath: params.evidence,
 		URL:          notifierURL,
 		Writer:       dw,
 		events:       events,
+		done:         done,
 	}
-	return eWriter, nil
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			phases.finish(time.Now())
+			close(done)
+			log.Close()
+		})
+	}
+	return eWriter, stop, nil
 }
 
-func eventThrottle(events <-chan event, syncSender func(event)) {
+// eventThrottle forwards events to syncSender, at most one progress event
+// per second, until events or done is closed. It checks in as component
+// after each completed send, and while it waits for events unless a send
+// is taking longer than heartbeatInterval.
+func eventThrottle(events <-chan event, done <-chan struct{}, component string, syncSender func(event)) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	var mu sync.Mutex
+	sending := map[*event]time.Time{}
+	// sends ending after the throttle stop must not check in again
+	stopped := false
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		stopped = true
+		liveness.stop(component)
+	}()
+	liveness.beat(component)
 	last := time.Now().Add(-1 * time.Second)
-	for ev := range events {
-		if ev.Type == "progress" {
-			if time.Since(last) < time.Second {
-				continue
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			mu.Lock()
+			stuck := false
+			for _, start := range sending {
+				stuck = stuck || time.Since(start) > heartbeatInterval
 			}
-			last = time.Now()
+			mu.Unlock()
+			if !stuck {
+				liveness.beat(component)
+			}
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if ev.Type == "progress" {
+				if time.Since(last) < time.Second {
+					continue
+				}
+				last = time.Now()
+			}
+			mu.Lock()
+			sending[&ev] = time.Now()
+			mu.Unlock()
+			go func(ev *event) {
+				syncSender(*ev)
+				mu.Lock()
+				defer mu.Unlock()
+				delete(sending, ev)
+				if !stopped {
+					liveness.beat(component)
+				}
+			}(&ev)
 		}
-		go func(ev event) {
-			syncSender(ev)
-		}(ev)
 	}
 }
 
@@ -152,19 +489,38 @@ func coreRun(params ipedParams, logWriter io.Writer) error {
 	cmd.Dir = path.Dir(params.evidence)
 	cmd.Stdout = logWriter
 	cmd.Stderr = logWriter
-	err := cmd.Start()
+	err := startAs(cmd, params.runAs)
 	if err != nil {
+		params.audit.log("iped-start", map[string]string{"args": strings.Join(args, " "), "error": err.Error()})
 		return fmt.Errorf("error in execution: %v", err)
 	}
-	return cmd.Wait()
+	params.audit.log("iped-start", map[string]string{
+		"args": strings.Join(args, " "),
+		"dir":  cmd.Dir,
+		"pid":  fmt.Sprint(cmd.Process.Pid),
+	})
+	done := make(chan struct{})
+	defer close(done)
+	go watchProcess("progressWatcher/"+params.id, cmd.Process.Pid, done)
+	err = cmd.Wait()
+	exit := map[string]string{"exitCode": fmt.Sprint(cmd.ProcessState.ExitCode())}
+	if err != nil {
+		exit["error"] = err.Error()
+	}
+	params.audit.log("iped-exit", exit)
+	return err
 }
 
 func makeArgs(params ipedParams) []string {
+	maxHeap := params.maxHeap
+	if maxHeap == "" {
+		maxHeap = "6G"
+	}
 	args := []string{
 		"-Djava.awt.headless=true",
 		"-XX:+UnlockExperimentalVMOptions",
 		"-XX:+UseCGroupMemoryLimitForHeap",
-		"-Xmx6G",
+		"-Xmx" + maxHeap,
 		"-jar", params.jar,
 		"-d", path.Base(params.evidence),
 		"-o", params.output,
@@ -181,61 +537,53 @@ func makeArgs(params ipedParams) []string {
 			args = append(args, addArgsArray[i])
 		}
 	}
-	if params.additionalPaths != "" {
-		addPathsArray := strings.Split(params.additionalPaths, "\n")
-		for i := 0; i < len(addPathsArray); i++ {
-			args = append(args, "-d", addPathsArray[i])
-		}
+	for _, p := range additionalPaths(params) {
+		args = append(args, "-d", p)
 	}
 	return args
 }
 
-func makeIpedFolder(params ipedParams) (string, error) {
-	var ipedfolder string
-	// ipedfolder is the absolute path of the target output folder
-	// Ex: /data/mat1/SARD
-	// params.output will usually be 'SARD', but it can be an absolute path
+func additionalPaths(params ipedParams) []string {
+	if params.additionalPaths == "" {
+		return nil
+	}
+	return strings.Split(params.additionalPaths, "\n")
+}
+
+// caseFolder is the absolute path of the target output folder
+// Ex: /data/mat1/SARD
+// params.output will usually be 'SARD', but it can be an absolute path
+func caseFolder(params ipedParams) string {
 	if path.IsAbs(params.output) {
-		ipedfolder = params.output
-	} else {
-		ipedfolder = path.Join(path.Dir(params.evidence), params.output)
+		return params.output
 	}
+	return path.Join(path.Dir(params.evidence), params.output)
+}
+
+func makeIpedFolder(params ipedParams) (string, error) {
+	ipedfolder := caseFolder(params)
 	err := os.MkdirAll(ipedfolder, 0755)
 	if err != nil {
 		return "", err
 	}
-	err = os.Chmod(ipedfolder, 0750)
+	err = os.Chmod(ipedfolder, params.perms.RunningMode)
 	if err != nil {
 		return "", err
 	}
-	return ipedfolder, nil
-}
-
-func postActions(ipedfolder string) error {
-	err := os.Chmod(ipedfolder, 0755)
-	if err != nil {
-		return err
-	}
-	permPaths := []string{
-		"Ferramenta de Pesquisa.exe",
-		"IPED-SearchApp.exe",
-		"indexador/tools",
-		"indexador/jre/bin",
-		"indexador/lib",
-	}
-
-	for _, p := range permPaths {
-		permissions(ipedfolder, p)
+	if params.runAs.UID >= 0 || params.runAs.GID >= 0 {
+		// IPED writes the case as this user
+		err = os.Chown(ipedfolder, params.runAs.UID, params.runAs.GID)
+		if err != nil {
+			return "", err
+		}
 	}
-	return err
+	return ipedfolder, nil
 }
 
-func permissions(dirPath string, targetPath string) {
-	cmd := exec.Command("chmod", "-cR", "a+x", targetPath)
-	cmd.Dir = dirPath
-	out, err := cmd.CombinedOutput()
-	log.Printf("%v", string(out))
+func postActions(ipedfolder string, policy permPolicy) (permReport, error) {
+	err := os.Chmod(ipedfolder, policy.DoneMode)
 	if err != nil {
-		log.Printf("%v", err.Error())
+		return permReport{}, err
 	}
+	return applyPermPolicy(ipedfolder, policy), nil
 }
@@ -2,13 +2,14 @@ package main
 
 import (
 	"testing"
+	"time"
 )
 
 func TestEventThrottle(t *testing.T) {
 	t.Run("should call syncSender", func(t *testing.T) {
 		events := make(chan event)
 		calls := 0
-		go eventThrottle(events, func(event) {
+		go eventThrottle(events, nil, "test", func(event) {
 			calls++
 		})
 		events <- event{}
@@ -20,7 +21,7 @@ func TestEventThrottle(t *testing.T) {
 	t.Run("throttle fast progress events", func(t *testing.T) {
 		events := make(chan event)
 		calls := 0
-		go eventThrottle(events, func(event) {
+		go eventThrottle(events, nil, "test", func(event) {
 			calls++
 		})
 		events <- event{
@@ -41,3 +42,30 @@ func TestEventThrottle(t *testing.T) {
 		}
 	})
 }
+
+func TestEventThrottleHeartbeat(t *testing.T) {
+	events := make(chan event)
+	sending := make(chan struct{})
+	sent := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		eventThrottle(events, nil, "eventThrottle/heartbeat", func(event) {
+			close(sending)
+			<-sent
+		})
+		close(stopped)
+	}()
+	events <- event{Type: "phase"}
+	<-sending
+	close(events)
+	<-stopped
+	close(sent)
+	// the send checks in when it ends, after the throttle stopped
+	time.Sleep(50 * time.Millisecond)
+	liveness.mu.Lock()
+	_, ok := liveness.last["eventThrottle/heartbeat"]
+	liveness.mu.Unlock()
+	if ok {
+		t.Error("expected a stopped throttle not to check in")
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// credential is the user, groups and umask IPED runs with
+type credential struct {
+	// UID and GID of the IPED process, -1 keeps the worker's own
+	UID    int
+	GID    int
+	Groups []int
+	// Umask of the IPED process, -1 keeps the worker's own
+	Umask int
+	// FromShare takes UID and GID from the owner of the output share
+	// when they are not set
+	FromShare bool
+	// JobUIDs and JobGIDs bound the ids a job's runAs can set, any but
+	// root's when empty
+	JobUIDs idRanges
+	JobGIDs idRanges
+}
+
+// idRanges is a list of id ranges like "1000-1999,3000"
+type idRanges []idRange
+
+type idRange struct {
+	from, to int
+}
+
+func parseIDRanges(s string) (idRanges, error) {
+	ranges := idRanges{}
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		from, to := r, r
+		if i := strings.Index(r, "-"); i >= 0 {
+			from, to = r[:i], r[i+1:]
+		}
+		a, err := strconv.Atoi(from)
+		if err == nil && a < 0 {
+			err = fmt.Errorf("negative id")
+		}
+		b, berr := strconv.Atoi(to)
+		if err == nil && (berr != nil || b < a) {
+			err = fmt.Errorf("invalid range end")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid id range %q: %v", r, err)
+		}
+		ranges = append(ranges, idRange{a, b})
+	}
+	return ranges, nil
+}
+
+// allows tells if id is in the ranges, any id is when there are none
+func (ranges idRanges) allows(id int) bool {
+	if len(ranges) == 0 {
+		return true
+	}
+	for _, r := range ranges {
+		if id >= r.from && id <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+func defaultCredential() credential {
+	return credential{UID: -1, GID: -1, Umask: -1}
+}
+
+func (c credential) isSet() bool {
+	return c.UID >= 0 || c.GID >= 0 || len(c.Groups) > 0
+}
+
+// parseGroups parses a comma separated list of group ids
+func parseGroups(s string) ([]int, error) {
+	groups := []int{}
+	for _, g := range strings.Split(s, ",") {
+		g = strings.TrimSpace(g)
+		if g == "" {
+			continue
+		}
+		gid, err := strconv.Atoi(g)
+		if err != nil {
+			return nil, fmt.Errorf("invalid group %q: %v", g, err)
+		}
+		groups = append(groups, gid)
+	}
+	return groups, nil
+}
+
+// parseUmask parses an octal umask like "027"
+func parseUmask(s string) (int, error) {
+	if s == "" {
+		return -1, nil
+	}
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m > 0777 {
+		return -1, fmt.Errorf("invalid umask %q", s)
+	}
+	return int(m), nil
+}
+
+// outputShare is the folder where the case folder is created
+func outputShare(params ipedParams) string {
+	if path.IsAbs(params.output) {
+		return path.Dir(params.output)
+	}
+	return path.Dir(params.evidence)
+}
+
+// resolveCredential combines the worker credential with the job's runAs
+// ("uid:gid") and, if configured, the owner of the output share. A job can't
+// run IPED as root nor as ids out of the worker's JobUIDs and JobGIDs.
+func resolveCredential(base credential, runAs string, params ipedParams) (credential, error) {
+	cred := base
+	if runAs != "" {
+		uid, gid, err := parseOwner(runAs)
+		if err != nil {
+			return cred, err
+		}
+		if uid == 0 || gid == 0 {
+			return cred, fmt.Errorf("a job can't run IPED as root (runAs %q)", runAs)
+		}
+		if uid >= 0 && !base.JobUIDs.allows(uid) {
+			return cred, fmt.Errorf("uid %d is not allowed by RUN_AS_JOB_UIDS (runAs %q)", uid, runAs)
+		}
+		if gid >= 0 && !base.JobGIDs.allows(gid) {
+			return cred, fmt.Errorf("gid %d is not allowed by RUN_AS_JOB_GIDS (runAs %q)", gid, runAs)
+		}
+		// the part runAs leaves out is kept from the worker credential
+		if uid >= 0 {
+			cred.UID = uid
+		}
+		if gid >= 0 {
+			cred.GID = gid
+		}
+	}
+	if cred.FromShare && (cred.UID < 0 || cred.GID < 0) {
+		uid, gid, err := fileOwner(outputShare(params))
+		if err != nil {
+			return cred, fmt.Errorf("could not read owner of output share: %v", err)
+		}
+		if cred.UID < 0 {
+			cred.UID = uid
+		}
+		if cred.GID < 0 {
+			cred.GID = gid
+		}
+	}
+	return cred, nil
+}
+
+// startAs starts cmd with the given credential
+func startAs(cmd *exec.Cmd, cred credential) error {
+	if cred.isSet() {
+		err := setCredential(cmd, cred)
+		if err != nil {
+			return err
+		}
+	}
+	if cred.Umask >= 0 {
+		err := withUmask(cmd, cred.Umask)
+		if err != nil {
+			return err
+		}
+	}
+	return cmd.Start()
+}
+
+// withUmask makes cmd set umask in the child through a shell, which then
+// execs the command, so the worker's own umask never changes
+func withUmask(cmd *exec.Cmd, umask int) error {
+	if !path.IsAbs(cmd.Path) {
+		// the command was not found, Start reports it
+		return nil
+	}
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		return fmt.Errorf("could not find a shell to set the umask: %v", err)
+	}
+	script := fmt.Sprintf(`umask %03o && exec "$0" "$@"`, umask)
+	cmd.Args = append([]string{"sh", "-c", script, cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = sh
+	return nil
+}
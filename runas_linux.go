@@ -0,0 +1,45 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+func setCredential(cmd *exec.Cmd, cred credential) error {
+	uid, gid := cred.UID, cred.GID
+	if uid < 0 {
+		uid = os.Getuid()
+	}
+	if gid < 0 {
+		gid = os.Getgid()
+	}
+	groups := make([]uint32, len(cred.Groups))
+	for i, g := range cred.Groups {
+		groups[i] = uint32(g)
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid:    uint32(uid),
+		Gid:    uint32(gid),
+		Groups: groups,
+	}
+	return nil
+}
+
+func fileOwner(p string) (int, int, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return -1, -1, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return -1, -1, syscall.ENOTSUP
+	}
+	return int(stat.Uid), int(stat.Gid), nil
+}
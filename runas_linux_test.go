@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestStartAsUmask(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no shell")
+	}
+	before := syscall.Umask(022)
+	syscall.Umask(before)
+	var out bytes.Buffer
+	cmd := exec.Command("sh", "-c", "umask")
+	cmd.Stdout = &out
+	cred := defaultCredential()
+	cred.Umask = 027
+	err := startAs(cmd, cred)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(out.String()); got != "0027" {
+		t.Errorf("expected child umask: 0027, got: %q", got)
+	}
+	after := syscall.Umask(before)
+	if after != before {
+		t.Errorf("worker umask changed from %o to %o", before, after)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+func setCredential(cmd *exec.Cmd, cred credential) error {
+	return fmt.Errorf("running IPED as another user is not supported on this platform")
+}
+
+func fileOwner(p string) (int, int, error) {
+	return -1, -1, fmt.Errorf("file owners are not supported on this platform")
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestResolveCredential(t *testing.T) {
+	dir, err := ioutil.TempDir("", "share")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	params := ipedParams{
+		evidence: path.Join(dir, "image.E01"),
+		output:   "SARD",
+	}
+
+	t.Run("job runAs overrides worker credential", func(t *testing.T) {
+		base := defaultCredential()
+		base.UID, base.GID = 1000, 1000
+		cred, err := resolveCredential(base, "2000:3000", params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cred.UID != 2000 || cred.GID != 3000 {
+			t.Errorf("expected: 2000:3000, got: %v:%v", cred.UID, cred.GID)
+		}
+	})
+	t.Run("job runAs without group keeps the worker group", func(t *testing.T) {
+		base := defaultCredential()
+		base.UID, base.GID = 1000, 1000
+		cred, err := resolveCredential(base, "2000", params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cred.UID != 2000 || cred.GID != 1000 {
+			t.Errorf("expected: 2000:1000, got: %v:%v", cred.UID, cred.GID)
+		}
+	})
+	t.Run("job runAs can't be root", func(t *testing.T) {
+		for _, runAs := range []string{"0:0", "0", ":0", "2000:0"} {
+			if _, err := resolveCredential(defaultCredential(), runAs, params); err == nil {
+				t.Errorf("expected runAs %q to be rejected", runAs)
+			}
+		}
+	})
+	t.Run("job runAs bounded by the worker", func(t *testing.T) {
+		base := defaultCredential()
+		base.JobUIDs, _ = parseIDRanges("1000-1999,3000")
+		base.JobGIDs, _ = parseIDRanges("1000")
+		if _, err := resolveCredential(base, "3000:1000", params); err != nil {
+			t.Error(err)
+		}
+		for _, runAs := range []string{"2000:1000", "1500:1001", "999"} {
+			if _, err := resolveCredential(base, runAs, params); err == nil {
+				t.Errorf("expected runAs %q to be rejected", runAs)
+			}
+		}
+	})
+	t.Run("owner of the output share", func(t *testing.T) {
+		base := defaultCredential()
+		base.FromShare = true
+		base.GID = 4000
+		cred, err := resolveCredential(base, "", params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cred.UID != os.Getuid() || cred.GID != 4000 {
+			t.Errorf("expected: %v:4000, got: %v:%v", os.Getuid(), cred.UID, cred.GID)
+		}
+	})
+	t.Run("unset", func(t *testing.T) {
+		cred, err := resolveCredential(defaultCredential(), "", params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cred.isSet() {
+			t.Errorf("expected unset credential, got: %v", cred)
+		}
+	})
+}
+
+func TestParseUmask(t *testing.T) {
+	umask, err := parseUmask("027")
+	if err != nil || umask != 027 {
+		t.Errorf("expected: 027, got: %o %v", umask, err)
+	}
+	if _, err := parseUmask("999"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestParseIDRanges(t *testing.T) {
+	ranges, err := parseIDRanges("1000-1999, 3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, allowed := range map[int]bool{999: false, 1000: true, 1999: true, 2000: false, 3000: true} {
+		if ranges.allows(id) != allowed {
+			t.Errorf("expected allows(%d) to be %v", id, allowed)
+		}
+	}
+	if empty, _ := parseIDRanges(""); !empty.allows(5) {
+		t.Error("expected no ranges to allow any id")
+	}
+	for _, s := range []string{"a", "-5", "10-5", "1-"} {
+		if _, err := parseIDRanges(s); err == nil {
+			t.Errorf("expected %q to be invalid", s)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// jobResources is what a job reserves from the worker budget
+type jobResources struct {
+	CPUs   float64
+	Memory int64
+}
+
+// slot runs one IPED process at a time and holds its own lock
+type slot struct {
+	ID        int
+	locker    *remoteLocker
+	busy      bool
+	resources jobResources
+}
+
+// slotScheduler runs jobs concurrently, bounded by the number of slots and
+// by the CPU and memory budgets of the worker. A budget of zero is unbounded.
+type slotScheduler struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	slots      []*slot
+	budget     jobResources
+	reserved   jobResources
+	defaultJob jobResources
+
+	slotBusy       *prometheus.Desc
+	reservedCPUs   *prometheus.Desc
+	reservedMemory *prometheus.Desc
+	budgetCPUs     *prometheus.Desc
+	budgetMemory   *prometheus.Desc
+}
+
+// capacity is the free capacity of a worker
+type capacity struct {
+	Ready      bool    `json:"ready"`
+	Slots      int     `json:"slots"`
+	FreeSlots  int     `json:"freeSlots"`
+	CPUs       float64 `json:"cpus,omitempty"`
+	FreeCPUs   float64 `json:"freeCpus,omitempty"`
+	Memory     int64   `json:"memory,omitempty"`
+	FreeMemory int64   `json:"freeMemory,omitempty"`
+}
+
+func newSlotScheduler(lockURL string, slots int, budget jobResources, defaultJob jobResources) *slotScheduler {
+	s := &slotScheduler{
+		budget:     budget,
+		defaultJob: defaultJob,
+		slotBusy: prometheus.NewDesc("ipedworker_slot_busy",
+			"Whether a slot is running a job or not", []string{"slot"}, nil),
+		reservedCPUs: prometheus.NewDesc("ipedworker_slots_reserved_cpus",
+			"CPUs reserved by running jobs", nil, nil),
+		reservedMemory: prometheus.NewDesc("ipedworker_slots_reserved_memory_bytes",
+			"Memory reserved by running jobs", nil, nil),
+		budgetCPUs: prometheus.NewDesc("ipedworker_slots_budget_cpus",
+			"CPU budget of the worker, 0 is unbounded", nil, nil),
+		budgetMemory: prometheus.NewDesc("ipedworker_slots_budget_memory_bytes",
+			"Memory budget of the worker, 0 is unbounded", nil, nil),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	for i := 0; i < slots; i++ {
+		s.slots = append(s.slots, &slot{
+			ID:     i,
+			locker: &remoteLocker{URL: lockURL},
+		})
+	}
+	return s
+}
+
+// fits tells whether res can be reserved now. A job bigger than the whole
+// budget still runs, alone, so it does not wait forever.
+func (s *slotScheduler) fits(res jobResources) bool {
+	busy := 0
+	for _, sl := range s.slots {
+		if sl.busy {
+			busy++
+		}
+	}
+	if busy == len(s.slots) {
+		return false
+	}
+	if busy == 0 {
+		return true
+	}
+	if s.budget.CPUs > 0 && s.reserved.CPUs+res.CPUs > s.budget.CPUs {
+		return false
+	}
+	if s.budget.Memory > 0 && s.reserved.Memory+res.Memory > s.budget.Memory {
+		return false
+	}
+	return true
+}
+
+// resourcesFor is what a job asks for, or the worker default
+func (s *slotScheduler) resourcesFor(job Job) (jobResources, error) {
+	res := s.defaultJob
+	if job.CPUs > 0 {
+		res.CPUs = job.CPUs
+	}
+	if job.Memory != "" {
+		memory, err := parseMemory(job.Memory)
+		if err != nil {
+			return res, err
+		}
+		res.Memory = memory
+	}
+	return res, nil
+}
+
+// acquire blocks until a slot and the resources are available, or ctx is
+// done. Jobs wait on their own, so a smaller job that fits starts before a
+// bigger one waiting for resources.
+func (s *slotScheduler) acquire(ctx context.Context, res jobResources) (*slot, error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		case <-done:
+		}
+	}()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.fits(res) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		s.cond.Wait()
+	}
+	for _, sl := range s.slots {
+		if !sl.busy {
+			sl.busy = true
+			sl.resources = res
+			s.reserved.CPUs += res.CPUs
+			s.reserved.Memory += res.Memory
+			return sl, nil
+		}
+	}
+	panic("no free slot")
+}
+
+func (s *slotScheduler) release(sl *slot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sl.busy = false
+	s.reserved.CPUs -= sl.resources.CPUs
+	s.reserved.Memory -= sl.resources.Memory
+	sl.resources = jobResources{}
+	s.cond.Broadcast()
+}
+
+func (s *slotScheduler) capacity() capacity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := capacity{
+		Ready:  s.fits(s.defaultJob),
+		Slots:  len(s.slots),
+		CPUs:   s.budget.CPUs,
+		Memory: s.budget.Memory,
+	}
+	for _, sl := range s.slots {
+		if !sl.busy {
+			c.FreeSlots++
+		}
+	}
+	if s.budget.CPUs > 0 {
+		c.FreeCPUs = s.budget.CPUs - s.reserved.CPUs
+	}
+	if s.budget.Memory > 0 {
+		c.FreeMemory = s.budget.Memory - s.reserved.Memory
+	}
+	return c
+}
+
+// Describe implements prometheus.Collector
+func (s *slotScheduler) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.slotBusy
+	ch <- s.reservedCPUs
+	ch <- s.reservedMemory
+	ch <- s.budgetCPUs
+	ch <- s.budgetMemory
+}
+
+// Collect implements prometheus.Collector
+func (s *slotScheduler) Collect(ch chan<- prometheus.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sl := range s.slots {
+		busy := 0.0
+		if sl.busy {
+			busy = 1
+		}
+		ch <- prometheus.MustNewConstMetric(s.slotBusy, prometheus.GaugeValue, busy, strconv.Itoa(sl.ID))
+	}
+	ch <- prometheus.MustNewConstMetric(s.reservedCPUs, prometheus.GaugeValue, s.reserved.CPUs)
+	ch <- prometheus.MustNewConstMetric(s.reservedMemory, prometheus.GaugeValue, float64(s.reserved.Memory))
+	ch <- prometheus.MustNewConstMetric(s.budgetCPUs, prometheus.GaugeValue, s.budget.CPUs)
+	ch <- prometheus.MustNewConstMetric(s.budgetMemory, prometheus.GaugeValue, float64(s.budget.Memory))
+}
+
+// parseBytes parses sizes like "6G", "512M" or "1073741824"
+func parseBytes(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(s, "B")
+	mult := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// parseMemory parses a memory budget, which is at least the 1M the JVM heap
+// is sized in, or 0
+func parseMemory(s string) (int64, error) {
+	n, err := parseBytes(s)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 && n < 1<<20 {
+		return 0, fmt.Errorf("invalid memory %q: must be at least 1M", s)
+	}
+	return n, nil
+}
+
+// heapSize formats bytes as a JVM -Xmx value
+func heapSize(b int64) string {
+	if b%(1<<30) == 0 {
+		return fmt.Sprintf("%dG", b>>30)
+	}
+	return fmt.Sprintf("%dM", b>>20)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSlotScheduler(t *testing.T) {
+	ctx := context.Background()
+	t.Run("bounded by memory budget", func(t *testing.T) {
+		s := newSlotScheduler("", 3, jobResources{CPUs: 8, Memory: 10 << 30}, jobResources{CPUs: 2, Memory: 6 << 30})
+		first, _ := s.acquire(ctx, jobResources{CPUs: 2, Memory: 6 << 30})
+		if c := s.capacity(); c.Ready || c.FreeSlots != 2 || c.FreeMemory != 4<<30 {
+			t.Errorf("unexpected capacity: %+v", c)
+		}
+		small, _ := s.acquire(ctx, jobResources{CPUs: 2, Memory: 2 << 30})
+		acquired := make(chan *slot)
+		go func() {
+			sl, _ := s.acquire(ctx, jobResources{CPUs: 2, Memory: 6 << 30})
+			acquired <- sl
+		}()
+		select {
+		case <-acquired:
+			t.Fatal("acquired a slot beyond the memory budget")
+		case <-time.After(50 * time.Millisecond):
+		}
+		s.release(first)
+		third := <-acquired
+		s.release(small)
+		s.release(third)
+		if c := s.capacity(); !c.Ready || c.FreeSlots != 3 || c.FreeCPUs != 8 {
+			t.Errorf("unexpected capacity: %+v", c)
+		}
+	})
+	t.Run("job bigger than the budget runs alone", func(t *testing.T) {
+		s := newSlotScheduler("", 2, jobResources{Memory: 4 << 30}, jobResources{})
+		sl, _ := s.acquire(ctx, jobResources{Memory: 8 << 30})
+		if c := s.capacity(); c.FreeSlots != 1 || c.Ready {
+			t.Errorf("unexpected capacity: %+v", c)
+		}
+		s.release(sl)
+	})
+	t.Run("smaller job passes a bigger one waiting", func(t *testing.T) {
+		s := newSlotScheduler("", 3, jobResources{Memory: 10 << 30}, jobResources{})
+		first, _ := s.acquire(ctx, jobResources{Memory: 6 << 30})
+		big := make(chan *slot)
+		go func() {
+			sl, _ := s.acquire(ctx, jobResources{Memory: 8 << 30})
+			big <- sl
+		}()
+		small := make(chan *slot)
+		go func() {
+			sl, _ := s.acquire(ctx, jobResources{Memory: 2 << 30})
+			small <- sl
+		}()
+		select {
+		case sl := <-small:
+			s.release(sl)
+		case <-big:
+			t.Fatal("acquired a slot beyond the memory budget")
+		case <-time.After(time.Second):
+			t.Fatal("the smaller job waited behind the bigger one")
+		}
+		s.release(first)
+		s.release(<-big)
+	})
+	t.Run("waiting is cancelled", func(t *testing.T) {
+		s := newSlotScheduler("", 1, jobResources{}, jobResources{})
+		first, _ := s.acquire(ctx, jobResources{})
+		cancelled, cancel := context.WithCancel(ctx)
+		errs := make(chan error)
+		go func() {
+			_, err := s.acquire(cancelled, jobResources{})
+			errs <- err
+		}()
+		cancel()
+		if err := <-errs; err == nil {
+			t.Error("expected error")
+		}
+		s.release(first)
+	})
+	t.Run("job resources", func(t *testing.T) {
+		s := newSlotScheduler("", 1, jobResources{}, jobResources{CPUs: 4, Memory: 6 << 30})
+		res, err := s.resourcesFor(Job{Memory: "12G"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.CPUs != 4 || res.Memory != 12<<30 {
+			t.Errorf("unexpected resources: %+v", res)
+		}
+		if heapSize(res.Memory) != "12G" {
+			t.Errorf("expected: 12G, got: %v", heapSize(res.Memory))
+		}
+		for _, invalid := range []string{"lots", "512K", "1000"} {
+			if _, err := s.resourcesFor(Job{Memory: invalid}); err == nil {
+				t.Errorf("memory %s: expected error", invalid)
+			}
+		}
+	})
+}
+
+func TestParseBytes(t *testing.T) {
+	cases := map[string]int64{
+		"6G":    6 << 30,
+		"512M":  512 << 20,
+		"1.5gb": 3 << 29,
+		"1024":  1024,
+	}
+	for input, expect := range cases {
+		got, err := parseBytes(input)
+		if err != nil || got != expect {
+			t.Errorf("%s: expected: %v, got: %v %v", input, expect, got, err)
+		}
+	}
+}
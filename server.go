@@ -2,9 +2,14 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"log"
 	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -18,17 +23,38 @@ type ServeOptions struct {
 	jar         string
 }
 
-// Serve creates the web server
-func Serve(port string, locker *remoteLocker) context.Context {
+// Serve creates the web server, accepting jobs on /jobs if submissions is
+// not nil
+func Serve(port string, scheduler *slotScheduler, state *workerState, submissions *httpSource) context.Context {
 	router := mux.NewRouter()
 	endpoints := []string{}
 
 	router.HandleFunc("/healthz", healthz).Methods("GET")
 	endpoints = append(endpoints, "/healthz")
 
-	router.HandleFunc("/readiness", readiness(locker)).Methods("GET")
+	router.HandleFunc("/readiness", readiness(scheduler)).Methods("GET")
 	endpoints = append(endpoints, "/readiness")
 
+	router.HandleFunc("/status", statusHandler(state, scheduler)).Methods("GET")
+	endpoints = append(endpoints, "/status")
+
+	router.HandleFunc("/jobs/{id}/log", logStream(state)).Methods("GET")
+	endpoints = append(endpoints, "/jobs/current/log")
+
+	router.HandleFunc("/events", eventStream(bus)).Methods("GET")
+	endpoints = append(endpoints, "/events")
+
+	if submissions != nil {
+		router.HandleFunc("/jobs", submissions.handler).Methods("POST")
+		endpoints = append(endpoints, "/jobs")
+
+		router.HandleFunc("/queue", submissions.queueHandler(state, scheduler)).Methods("GET")
+		endpoints = append(endpoints, "/queue")
+	}
+
+	router.HandleFunc("/config", configHandler(flag.CommandLine)).Methods("GET")
+	endpoints = append(endpoints, "/config")
+
 	router.Handle("/metrics", promhttp.Handler())
 	endpoints = append(endpoints, "/metrics")
 
@@ -39,14 +65,11 @@ func Serve(port string, locker *remoteLocker) context.Context {
 		srv.Shutdown(ctx)
 	}()
 	go func() {
-		log.Println("Listening on port", port)
-		log.Println("Endpoints:")
-		for _, x := range endpoints {
-			log.Println(x)
-		}
+		logger.Info("listening", "port", port, "endpoints", endpoints)
 		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
 			// unexpected error. port in use?
-			log.Fatalf("ListenAndServe(): %v", err)
+			logger.Error("could not serve", "err", err)
+			os.Exit(1)
 		}
 	}()
 	return ctx
@@ -54,55 +77,194 @@ func Serve(port string, locker *remoteLocker) context.Context {
 
 func healthz(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
+	err := liveness.check()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	w.Write([]byte("ok"))
 }
 
-func readiness(locker *remoteLocker) func(w http.ResponseWriter, r *http.Request) {
+func readiness(scheduler *slotScheduler) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
-		if locker.EvidencePath != "" {
-			http.Error(w, "not ready", http.StatusServiceUnavailable)
-			return
+		c := scheduler.capacity()
+		w.Header().Set("Content-Type", "application/json")
+		if !c.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
 		}
-		w.Write([]byte("ok"))
+		json.NewEncoder(w).Encode(c)
+	}
+}
+
+// workerOptions are the settings shared by every job of a worker
+type workerOptions struct {
+	jar         string
+	notifierURL string
+	perms       permPolicy
+	runAs       credential
+	logRotation logRotation
+
+	metricLabels     []string
+	metricsRetention time.Duration
+}
+
+// queuedJob is a job from a JobSource
+type queuedJob struct {
+	Job
+	// attempt counts the deliveries of the job by its source, 0 if unknown
+	attempt int
+	// finished is called with the result of the job
+	finished func(err error)
+	// release gives a job taken from a shared source back, when the worker
+	// stops before starting it
+	release func()
+	// scheduled is closed once the job has its slot, or will not get one,
+	// so its source only checks readiness again after that
+	scheduled chan struct{}
+}
+
+// markScheduled tells the source the job has its slot or will not get one
+func (q queuedJob) markScheduled() {
+	if q.scheduled != nil {
+		close(q.scheduled)
 	}
 }
 
-func processPayloads(ctx context.Context, payloads []Job, jar string, locker *remoteLocker, notifierURL string) {
-	metrics := createIpedMetrics()
+// processPayloads runs the jobs of source as slots free up, until the source
+// is exhausted or ctx is done, and waits for the running ones
+func processPayloads(ctx context.Context, source JobSource, scheduler *slotScheduler, state *workerState, opts workerOptions) {
+	metrics := createIpedMetrics(opts.metricLabels, opts.metricsRetention)
+	jobs := make(chan queuedJob)
+	go source.Run(ctx, jobs, func() bool {
+		return scheduler.capacity().Ready
+	})
+	queueLen := func() int {
+		if q, ok := source.(queueLength); ok {
+			return q.queued()
+		}
+		return 0
+	}
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	var err error
-	for _, payload := range payloads {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	// the loop checks in on each iteration, and while it waits for jobs
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	defer liveness.stop("jobLoop")
+	// waiting counts the jobs taken from the source waiting for a slot
+	var waiting int32
+	state.setQueued(queueLen())
+	for {
+		liveness.beat("jobLoop")
+		var queued queuedJob
+		var ok bool
 		select {
 		case <-ctx.Done():
-			if err != nil {
-				log.Fatalf("error: %v\n", err)
-			}
 			return
-		default:
-			params := ipedParams{
-				jar:             jar,
-				evidence:        payload.EvidencePath,
-				output:          payload.OutputPath,
-				profile:         payload.Profile,
-				additionalArgs:  payload.AdditionalArgs,
-				additionalPaths: payload.AdditionalPaths,
-				mvPath:          payload.mvPath,
+		case <-ticker.C:
+			continue
+		case queued, ok = <-jobs:
+			if !ok {
+				return
+			}
+		}
+		payload := queued.Job
+		finished := queued.finished
+		if finished == nil {
+			finished = func(error) {}
+		}
+		res, err := scheduler.resourcesFor(payload)
+		if err != nil {
+			logger.Error("invalid job resources", "job", payload.ID, "evidence", payload.EvidencePath, "err", err)
+			queued.markScheduled()
+			finished(failure("validation", err))
+			continue
+		}
+		id := payload.ID
+		if id == "" {
+			id = newJobID()
+		}
+		params := jobParams(payload, opts, res)
+		params.id = id
+		params.attempt = queued.attempt
+		if params.attempt < 1 {
+			params.attempt = 1
+		}
+		jobCtx := withLogger(withTraceParent(ctx, payload.TraceParent, payload.TraceState), jobLogger(params))
+		atomic.AddInt32(&waiting, 1)
+		state.setQueued(queueLen() + int(atomic.LoadInt32(&waiting)))
+		wg.Add(1)
+		go func(jobCtx context.Context, queued queuedJob, params ipedParams, res jobResources, finished func(error)) {
+			defer wg.Done()
+			sl, err := scheduler.acquire(jobCtx, res)
+			queued.markScheduled()
+			atomic.AddInt32(&waiting, -1)
+			state.setQueued(queueLen() + int(atomic.LoadInt32(&waiting)))
+			if err != nil {
+				if queued.release != nil {
+					queued.release()
+				}
+				return
 			}
-			err = runIped(params, locker, notifierURL, metrics)
+			params.status = state.start(params.id, params.evidence, sl.ID)
+			err = runIped(jobCtx, params, sl.locker, opts.notifierURL, metrics)
+			params.status.finish()
+			scheduler.release(sl)
 			if err != nil {
-				fmt.Printf("error: %v\n", err)
+				loggerFrom(jobCtx).Error("job failed", "reason", failureReason(err), "err", err)
 			}
-		}
+			finished(err)
+		}(jobCtx, queued, params, res, finished)
+	}
+}
+
+// jobParams are the runIped parameters of a job
+func jobParams(job Job, opts workerOptions, res jobResources) ipedParams {
+	params := ipedParams{
+		id:              job.ID,
+		jar:             opts.jar,
+		evidence:        job.EvidencePath,
+		output:          job.OutputPath,
+		profile:         job.Profile,
+		additionalArgs:  job.AdditionalArgs,
+		additionalPaths: job.AdditionalPaths,
+		mvPath:          job.MvPath,
+		perms:           opts.perms,
+		runAs:           opts.runAs,
+		progress:        newProgressParser(ipedLocale(opts.jar, job.Profile)),
+		logRotation:     opts.logRotation,
+		jobRunAs:        job.RunAs,
+	}
+	if res.Memory > 0 {
+		params.maxHeap = heapSize(res.Memory)
 	}
+	return params
 }
 
 type Job struct {
-	EvidencePath    string `json:"evidencePath,omitempty"`
-	OutputPath      string `json:"outputPath,omitempty"`
-	Profile         string `json:"profile,omitempty"`
-	AdditionalArgs  string `json:"additionalArgs,omitempty"`
-	AdditionalPaths string `json:"additionalPaths,omitempty"`
-	MvPath 		string `json:"mvPath,omitempty"`
+	ID              string  `json:"id,omitempty"`
+	EvidencePath    string  `json:"evidencePath,omitempty"`
+	OutputPath      string  `json:"outputPath,omitempty"`
+	Profile         string  `json:"profile,omitempty"`
+	AdditionalArgs  string  `json:"additionalArgs,omitempty"`
+	AdditionalPaths string  `json:"additionalPaths,omitempty"`
+	MvPath          string  `json:"mvPath,omitempty"`
+	RunAs           string  `json:"runAs,omitempty"`
+	CPUs            float64 `json:"cpus,omitempty"`
+	Memory          string  `json:"memory,omitempty"`
+	// TraceParent is the W3C trace context of the request, the job span is
+	// its child
+	TraceParent string `json:"traceParent,omitempty"`
+	// TraceState is the W3C tracestate of the request, passed on with the
+	// trace context
+	TraceState string `json:"traceState,omitempty"`
+	// Priority orders the jobs a worker holds, higher first
+	Priority int `json:"priority,omitempty"`
+	// Requester is who asked for the job, jobs of the same priority are
+	// shared fairly among requesters
+	Requester string `json:"requester,omitempty"`
+	// SubmittedAt is when the job was queued on this worker
+	SubmittedAt time.Time `json:"-"`
 }
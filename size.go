@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// firstSegment matches the first segment of split images: EnCase (E01,
+// Ex01, L01, Lx01) and raw (001, 0001)
+var firstSegment = regexp.MustCompile(`(?i)^\.(?:(e|ex|l|lx)01|(0+1))$`)
+
+// splitSegments returns the segments of a split image, starting with p, or
+// just p if it is not the first segment of a split image
+func splitSegments(p string) ([]string, error) {
+	ext := filepath.Ext(p)
+	matches := firstSegment.FindStringSubmatch(ext)
+	if matches == nil {
+		return []string{p}, nil
+	}
+	var segment *regexp.Regexp
+	base := strings.TrimSuffix(filepath.Base(p), ext)
+	if matches[1] != "" {
+		// E01..E99, EAA..EZZ
+		segment = regexp.MustCompile(`(?i)^` + regexp.QuoteMeta(base+"."+matches[1]) + `[0-9A-Z]{2}$`)
+	} else {
+		segment = regexp.MustCompile(`^` + regexp.QuoteMeta(base) + `\.[0-9]{` + strconv.Itoa(len(matches[2])) + `}$`)
+	}
+	entries, err := ioutil.ReadDir(filepath.Dir(p))
+	if err != nil {
+		return nil, err
+	}
+	segments := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && segment.MatchString(entry.Name()) {
+			segments = append(segments, filepath.Join(filepath.Dir(p), entry.Name()))
+		}
+	}
+	return segments, nil
+}
+
+// pathSize is the size of a file, of every segment of a split image or of
+// every file below a folder
+func pathSize(p string) (int64, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return 0, err
+	}
+	if !info.IsDir() {
+		segments, err := splitSegments(p)
+		if err != nil {
+			return 0, err
+		}
+		size := int64(0)
+		for _, segment := range segments {
+			info, err := os.Stat(segment)
+			if err != nil {
+				return 0, err
+			}
+			size += info.Size()
+		}
+		return size, nil
+	}
+	size := int64(0)
+	err = filepath.Walk(p, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// evidenceSize is the size of the evidence and its additional paths
+func evidenceSize(params ipedParams) (int64, error) {
+	size, err := pathSize(params.evidence)
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range additionalPaths(params) {
+		if !path.IsAbs(p) {
+			p = path.Join(path.Dir(params.evidence), p)
+		}
+		s, err := pathSize(p)
+		if err != nil {
+			return 0, err
+		}
+		size += s
+	}
+	return size, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEvidenceSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "evidence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]int{
+		"phone.E01":        100,
+		"phone.E02":        100,
+		"phone.E03":        50,
+		"phone.E01.txt":    7,
+		"other.E01":        1000,
+		"disk.001":         10,
+		"disk.002":         10,
+		"disk.0003":        1000,
+		"pendrive.Ex01":    20,
+		"pendrive.Ex02":    5,
+		"folder/a.txt":     3,
+		"folder/sub/b.txt": 4,
+		"single.dd":        8,
+	}
+	for name, size := range files {
+		p := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		ioutil.WriteFile(p, make([]byte, size), 0644)
+	}
+
+	segments, err := splitSegments(filepath.Join(dir, "phone.E01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{filepath.Join(dir, "phone.E01"), filepath.Join(dir, "phone.E02"), filepath.Join(dir, "phone.E03")}
+	if !reflect.DeepEqual(segments, expect) {
+		t.Errorf("expected: %v, got: %v", expect, segments)
+	}
+
+	cases := map[string]int64{
+		"phone.E01":     250,
+		"disk.001":      20,
+		"pendrive.Ex01": 25,
+		"folder":        7,
+		"single.dd":     8,
+		"phone.E02":     100,
+	}
+	for name, expect := range cases {
+		size, err := pathSize(filepath.Join(dir, name))
+		if err != nil || size != expect {
+			t.Errorf("%s: expected: %v, got: %v %v", name, expect, size, err)
+		}
+	}
+
+	params := ipedParams{
+		evidence:        filepath.Join(dir, "phone.E01"),
+		additionalPaths: "folder\n" + filepath.Join(dir, "single.dd"),
+	}
+	size, err := evidenceSize(params)
+	if err != nil || size != 265 {
+		t.Errorf("expected: 265, got: %v %v", size, err)
+	}
+}
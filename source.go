@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// JobSource feeds the job loop. Run sends jobs until ctx is done or the
+// source has no more of them, then closes jobs. Sources shared by several
+// workers only take a job when ready tells that it can start right away.
+type JobSource interface {
+	Run(ctx context.Context, jobs chan<- queuedJob, ready func() bool)
+}
+
+// queueLength is implemented by the sources that hold jobs waiting to start
+type queueLength interface {
+	queued() int
+}
+
+// withDefaults fills the settings a submitted job does not have from the
+// worker settings
+func withDefaults(job Job, defaults Job) Job {
+	if job.OutputPath == "" {
+		job.OutputPath = defaults.OutputPath
+	}
+	if job.Profile == "" {
+		job.Profile = defaults.Profile
+	}
+	if job.AdditionalArgs == "" {
+		job.AdditionalArgs = defaults.AdditionalArgs
+	}
+	if job.MvPath == "" {
+		job.MvPath = defaults.MvPath
+	}
+	return job
+}
+
+// offer waits for the job loop to take job, then for the job to have its
+// slot, checking in as component. If ctx is done before the job is taken it is
+// released and offer returns false.
+func offer(ctx context.Context, jobs chan<- queuedJob, job queuedJob, component string) bool {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case jobs <- job:
+			return waitScheduled(ctx, job, ticker, component)
+		case <-ticker.C:
+			liveness.beat(component)
+		case <-ctx.Done():
+			if job.release != nil {
+				job.release()
+			}
+			return false
+		}
+	}
+}
+
+// waitScheduled waits for a job taken by the job loop to have its slot, so
+// the next readiness check counts it
+func waitScheduled(ctx context.Context, job queuedJob, ticker *time.Ticker, component string) bool {
+	if job.scheduled == nil {
+		return true
+	}
+	for {
+		select {
+		case <-job.scheduled:
+			return true
+		case <-ticker.C:
+			liveness.beat(component)
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// sliceSource runs a fixed list of jobs, like the single job from the
+// environment
+type sliceSource struct {
+	mu   sync.Mutex
+	jobs []Job
+}
+
+func newSliceSource(jobs ...Job) *sliceSource {
+	return &sliceSource{jobs: jobs}
+}
+
+func (s *sliceSource) Run(ctx context.Context, jobs chan<- queuedJob, ready func() bool) {
+	defer close(jobs)
+	for {
+		s.mu.Lock()
+		if len(s.jobs) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		job := s.jobs[0]
+		s.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case jobs <- queuedJob{Job: job}:
+		}
+		s.mu.Lock()
+		s.jobs = s.jobs[1:]
+		s.mu.Unlock()
+	}
+}
+
+func (s *sliceSource) queued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.jobs)
+}
+
+// httpSource runs the jobs posted to /jobs, in fair share order. It only
+// picks a job when one can start, so later urgent jobs can pass ahead. Fair
+// share only orders these jobs: the spool and amqp sources are shared by the
+// workers of a lab and keep their own order, and watched folders have no
+// priority or requester.
+type httpSource struct {
+	mu       sync.Mutex
+	defaults Job
+	share    *fairShare
+	pending  []Job
+	// running are the IDs of the jobs taken by the job loop until they finish
+	running map[string]bool
+	wake    chan struct{}
+	// plan answers POST /jobs?dryRun=true
+	plan func(Job) jobPlan
+}
+
+func newHTTPSource(defaults Job, aging time.Duration) *httpSource {
+	return &httpSource{
+		defaults: defaults,
+		share:    newFairShare(aging),
+		running:  map[string]bool{},
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// submit queues a job and returns how many jobs are ahead of it, false if a
+// job with its ID is queued or running
+func (s *httpSource) submit(job Job) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running[job.ID] {
+		return 0, false
+	}
+	for _, j := range s.pending {
+		if j.ID == job.ID {
+			return 0, false
+		}
+	}
+	if job.SubmittedAt.IsZero() {
+		job.SubmittedAt = time.Now()
+	}
+	s.pending = append(s.pending, job)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	s.share.sort(s.pending, time.Now())
+	for i, j := range s.pending {
+		if j.ID == job.ID {
+			return i, true
+		}
+	}
+	return len(s.pending) - 1, true
+}
+
+func (s *httpSource) queued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+// ordered returns the pending jobs in the order they will run
+func (s *httpSource) ordered(now time.Time) []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.share.sort(s.pending, now)
+	return append([]Job{}, s.pending...)
+}
+
+// take moves a pending job to the running ones, false if it is gone
+func (s *httpSource) take(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, job := range s.pending {
+		if job.ID == id {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			s.running[id] = true
+			return true
+		}
+	}
+	return false
+}
+
+// finished forgets a running job, its ID can be submitted again
+func (s *httpSource) finished(job Job) {
+	s.mu.Lock()
+	delete(s.running, job.ID)
+	s.mu.Unlock()
+	s.share.finished(job.Requester)
+}
+
+func (s *httpSource) Run(ctx context.Context, jobs chan<- queuedJob, ready func() bool) {
+	defer close(jobs)
+	for {
+		var next []Job
+		if ready() {
+			next = s.ordered(time.Now())
+		}
+		if len(next) == 0 {
+			// readiness is polled, submissions wake up right away
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.wake:
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		job := next[0]
+		queued := queuedJob{
+			Job: job,
+			finished: func(error) {
+				s.finished(job)
+			},
+			scheduled: make(chan struct{}),
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+			// pick again, the new job may go first
+			continue
+		case jobs <- queued:
+		}
+		s.take(job.ID)
+		s.share.started(job.Requester, time.Now())
+		// pick the next job once this one has its slot
+		select {
+		case <-ctx.Done():
+			return
+		case <-queued.scheduled:
+		}
+	}
+}
+
+// submitted is the response to POST /jobs
+type submitted struct {
+	ID     string `json:"id"`
+	Ahead  int    `json:"ahead"`
+	Status string `json:"status"`
+}
+
+// handler accepts a Job as JSON, answering 202 with its id, 409 if a job with
+// its id is queued or running, or with its plan on a dry run
+func (s *httpSource) handler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	var job Job
+	err := decoder.Decode(&job)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid job: %v", err), http.StatusBadRequest)
+		return
+	}
+	if job.EvidencePath == "" {
+		http.Error(w, "invalid job: evidencePath not set", http.StatusBadRequest)
+		return
+	}
+	if job.TraceParent == "" {
+		job.TraceParent = r.Header.Get("traceparent")
+		job.TraceState = r.Header.Get("tracestate")
+	}
+	if job.ID == "" {
+		job.ID = newJobID()
+	}
+	if r.URL.Query().Get("dryRun") == "true" && s.plan != nil {
+		plan := s.plan(withDefaults(job, s.defaults))
+		w.Header().Set("Content-Type", "application/json")
+		if !plan.Valid {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		}
+		json.NewEncoder(w).Encode(plan)
+		return
+	}
+	// aging counts from the submission to this worker
+	job.SubmittedAt = time.Now()
+	ahead, ok := s.submit(withDefaults(job, s.defaults))
+	if !ok {
+		http.Error(w, fmt.Sprintf("job %s is already queued or running", job.ID), http.StatusConflict)
+		return
+	}
+	logger.Info("job submitted", "job", job.ID, "evidence", job.EvidencePath, "priority", job.Priority, "requester", job.Requester, "ahead", ahead)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(submitted{ID: job.ID, Ahead: ahead, Status: "queued"})
+}
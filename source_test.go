@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPSource(t *testing.T) {
+	s := newHTTPSource(Job{OutputPath: "SARD", Profile: "forensic"}, time.Hour)
+	tests := []struct {
+		body     string
+		expected int
+		ahead    int
+	}{
+		{`{"evidencePath": "/data/a.E01"}`, http.StatusAccepted, 0},
+		{`{"evidencePath": "/data/b.E01", "profile": "fastmode"}`, http.StatusAccepted, 1},
+		{`{"evidencePath": "/data/urgent.E01", "priority": 10}`, http.StatusAccepted, 0},
+		{`{"evidence": "/data/c.E01"}`, http.StatusBadRequest, 0},
+		{`{"profile": "fastmode"}`, http.StatusBadRequest, 0},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/jobs", strings.NewReader(test.body))
+		w := httptest.NewRecorder()
+		s.handler(w, req)
+		if w.Code != test.expected {
+			t.Errorf("%s: expected %d, got: %d %s", test.body, test.expected, w.Code, w.Body.String())
+			continue
+		}
+		if w.Code != http.StatusAccepted {
+			continue
+		}
+		var res submitted
+		json.NewDecoder(w.Body).Decode(&res)
+		if res.ID == "" || res.Ahead != test.ahead || res.Status != "queued" {
+			t.Errorf("%s: unexpected response: %+v", test.body, res)
+		}
+	}
+	if s.queued() != 3 {
+		t.Fatalf("expected 3 queued jobs, got: %d", s.queued())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	jobs := make(chan queuedJob)
+	go s.Run(ctx, jobs, func() bool { return true })
+	urgent := <-jobs
+	// the next job waits for this one to have its slot
+	select {
+	case job := <-jobs:
+		t.Fatalf("expected the source to wait for the slot of the first job, got: %+v", job.Job)
+	case <-time.After(50 * time.Millisecond):
+	}
+	urgent.markScheduled()
+	a := <-jobs
+	a.markScheduled()
+	b := <-jobs
+	b.markScheduled()
+	if urgent.EvidencePath != "/data/urgent.E01" {
+		t.Errorf("expected the urgent job first, got: %+v", urgent.Job)
+	}
+	if a.EvidencePath != "/data/a.E01" || a.Profile != "forensic" || a.OutputPath != "SARD" {
+		t.Errorf("unexpected first job: %+v", a.Job)
+	}
+	if b.EvidencePath != "/data/b.E01" || b.Profile != "fastmode" {
+		t.Errorf("unexpected second job: %+v", b.Job)
+	}
+}
+
+func TestHTTPSourceDuplicateID(t *testing.T) {
+	s := newHTTPSource(Job{}, time.Hour)
+	post := func() int {
+		w := httptest.NewRecorder()
+		s.handler(w, httptest.NewRequest("POST", "/jobs", strings.NewReader(`{"id": "a", "evidencePath": "/data/a.E01"}`)))
+		return w.Code
+	}
+	if code := post(); code != http.StatusAccepted {
+		t.Fatalf("expected 202, got: %d", code)
+	}
+	if code := post(); code != http.StatusConflict {
+		t.Errorf("expected 409 for a queued id, got: %d", code)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	jobs := make(chan queuedJob)
+	go s.Run(ctx, jobs, func() bool { return true })
+	job := <-jobs
+	job.markScheduled()
+	if code := post(); code != http.StatusConflict {
+		t.Errorf("expected 409 for a running id, got: %d", code)
+	}
+	job.finished(nil)
+	if code := post(); code != http.StatusAccepted {
+		t.Errorf("expected a finished id to be accepted again, got: %d", code)
+	}
+}
+
+func TestSliceSource(t *testing.T) {
+	s := newSliceSource(Job{EvidencePath: "/data/a.E01"})
+	jobs := make(chan queuedJob)
+	go s.Run(context.Background(), jobs, func() bool { return true })
+	if job := <-jobs; job.EvidencePath != "/data/a.E01" {
+		t.Errorf("unexpected job: %+v", job.Job)
+	}
+	if _, ok := <-jobs; ok {
+		t.Error("expected jobs to be closed after the last job")
+	}
+}
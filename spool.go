@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spoolSuffix = ".job.json"
+	ownerSuffix = ".owner.json"
+)
+
+// spool is a directory of *.job.json files, shared by the workers of a lab.
+// A worker claims a job by renaming its file into processing/, so only one
+// of them runs it, and moves it to done/ or failed/ with a .result.json file
+// when it finishes. Next to a claimed file, a .owner.json file names the
+// worker and is touched while it runs the job: a claim whose owner file was
+// not touched for a lease, or left by this host before a restart, is put
+// back in the spool.
+type spool struct {
+	dir      string
+	hostname string
+	// defaults fill the fields a job file does not set
+	defaults Job
+	// interval is the time between scans of the spool
+	interval time.Duration
+	// lease is the time after which a claim that was not renewed is stale
+	lease time.Duration
+}
+
+// spoolOwner is the content of the owner file of a claimed job
+type spoolOwner struct {
+	Worker  string    `json:"worker"`
+	PID     int       `json:"pid"`
+	Claimed time.Time `json:"claimed"`
+}
+
+// spoolResult is written next to a finished job file
+type spoolResult struct {
+	ID       string    `json:"id"`
+	Status   string    `json:"status"`
+	Reason   string    `json:"reason,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Worker   string    `json:"worker"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+func newSpool(dir string, defaults Job, interval, lease time.Duration) (*spool, error) {
+	for _, sub := range []string{"processing", "done", "failed"} {
+		err := os.MkdirAll(filepath.Join(dir, sub), 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return &spool{dir: dir, hostname: hostname, defaults: defaults, interval: interval, lease: lease}, nil
+}
+
+// pending lists the job files waiting in the spool, oldest first
+func (s *spool) pending() ([]string, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	files := []os.FileInfo{}
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() && strings.HasSuffix(entry.Name(), spoolSuffix) {
+			files = append(files, entry)
+		}
+	}
+	sort.SliceStable(files, func(a, b int) bool {
+		if files[a].ModTime().Equal(files[b].ModTime()) {
+			return files[a].Name() < files[b].Name()
+		}
+		return files[a].ModTime().Before(files[b].ModTime())
+	})
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = f.Name()
+	}
+	return names, nil
+}
+
+// claim moves a job file into processing/. It returns false if another
+// worker claimed it first. Invalid jobs are claimed and failed right away.
+func (s *spool) claim(name string) (queuedJob, bool, error) {
+	processing := filepath.Join(s.dir, "processing", name)
+	err := os.Rename(filepath.Join(s.dir, name), processing)
+	if os.IsNotExist(err) {
+		return queuedJob{}, false, nil
+	}
+	if err != nil {
+		return queuedJob{}, false, err
+	}
+	started := time.Now()
+	err = s.writeOwner(name, spoolOwner{Worker: s.hostname, PID: os.Getpid(), Claimed: started}, os.O_TRUNC)
+	if err != nil {
+		s.release(name)
+		return queuedJob{}, false, err
+	}
+	job, err := s.readJob(processing)
+	if err != nil {
+		s.finish(name, job, started, failure("validation", err))
+		return queuedJob{}, false, nil
+	}
+	stopRenew := s.renew(name)
+	return queuedJob{
+		Job: job,
+		finished: func(err error) {
+			stopRenew()
+			s.finish(name, job, started, err)
+		},
+		release: func() {
+			stopRenew()
+			s.release(name)
+		},
+		scheduled: make(chan struct{}),
+	}, true, nil
+}
+
+func (s *spool) ownerPath(name string) string {
+	return filepath.Join(s.dir, "processing", strings.TrimSuffix(name, spoolSuffix)+ownerSuffix)
+}
+
+func (s *spool) writeOwner(name string, owner spoolOwner, flag int) error {
+	j, err := json.Marshal(owner)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.ownerPath(name), os.O_CREATE|os.O_WRONLY|flag, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(j, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// renew touches the owner file of a claimed job every third of the lease,
+// until the returned function is called
+func (s *spool) renew(name string) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(s.lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				err := os.Chtimes(s.ownerPath(name), now, now)
+				if err != nil {
+					logger.Error("could not renew the spool claim", "file", name, "err", err)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// recoverClaims puts back in the spool the claims whose lease expired, and
+// at startup those of this host, which no process of it runs anymore
+func (s *spool) recoverClaims(startup bool) error {
+	entries, err := ioutil.ReadDir(filepath.Join(s.dir, "processing"))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, spoolSuffix) {
+			continue
+		}
+		owner, renewed, err := s.readOwner(name)
+		if os.IsNotExist(err) {
+			// claimed without an owner file, e.g. by an older worker or one
+			// that stopped right after the claim: its lease starts now,
+			// unless the claimer writes its owner file first
+			err = s.writeOwner(name, spoolOwner{Claimed: time.Now()}, os.O_EXCL)
+			if err == nil || os.IsExist(err) {
+				continue
+			}
+		}
+		if err != nil {
+			logger.Error("could not read the spool claim", "file", name, "err", err)
+			continue
+		}
+		own := startup && owner.Worker == s.hostname
+		if !own && time.Since(renewed) < s.lease {
+			continue
+		}
+		// taking the owner file first keeps another worker from recovering
+		// the same claim
+		taken := s.ownerPath(name) + fmt.Sprintf(".recovering-%s-%d", s.hostname, os.Getpid())
+		if os.Rename(s.ownerPath(name), taken) != nil {
+			continue
+		}
+		err = os.Rename(filepath.Join(s.dir, "processing", name), filepath.Join(s.dir, name))
+		os.Remove(taken)
+		if err != nil {
+			logger.Error("could not recover the spool claim", "file", name, "err", err)
+			continue
+		}
+		logger.Warn("requeued a stale spool claim", "file", name, "worker", owner.Worker, "renewed", renewed)
+	}
+	return nil
+}
+
+// readOwner returns the owner of a claim and when it was last renewed
+func (s *spool) readOwner(name string) (spoolOwner, time.Time, error) {
+	var owner spoolOwner
+	p := s.ownerPath(name)
+	info, err := os.Stat(p)
+	if err != nil {
+		return owner, time.Time{}, err
+	}
+	j, err := ioutil.ReadFile(p)
+	if err != nil {
+		return owner, time.Time{}, err
+	}
+	err = json.Unmarshal(j, &owner)
+	if err != nil {
+		return owner, time.Time{}, fmt.Errorf("invalid owner file: %v", err)
+	}
+	return owner, info.ModTime(), nil
+}
+
+func (s *spool) readJob(p string) (Job, error) {
+	job := Job{ID: strings.TrimSuffix(filepath.Base(p), spoolSuffix)}
+	f, err := os.Open(p)
+	if err != nil {
+		return job, err
+	}
+	defer f.Close()
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&job)
+	if err != nil {
+		return job, fmt.Errorf("invalid job file: %v", err)
+	}
+	if job.EvidencePath == "" {
+		return job, fmt.Errorf("invalid job file: evidencePath not set")
+	}
+	return withDefaults(job, s.defaults), nil
+}
+
+// finish moves a claimed job file to done/ or failed/ and writes its result
+func (s *spool) finish(name string, job Job, started time.Time, err error) {
+	result := spoolResult{
+		ID:       job.ID,
+		Status:   "done",
+		Worker:   s.hostname,
+		Started:  started,
+		Finished: time.Now(),
+	}
+	target := "done"
+	if err != nil {
+		target = "failed"
+		result.Status = "failed"
+		result.Reason = failureReason(err)
+		result.Error = err.Error()
+	}
+	j, _ := json.MarshalIndent(result, "", "  ")
+	base := strings.TrimSuffix(name, spoolSuffix)
+	resultPath := filepath.Join(s.dir, target, base+".result.json")
+	werr := ioutil.WriteFile(resultPath, append(j, '\n'), 0644)
+	if werr != nil {
+		logger.Error("could not write the spool result", "file", resultPath, "err", werr)
+	}
+	merr := os.Rename(filepath.Join(s.dir, "processing", name), filepath.Join(s.dir, target, name))
+	if merr != nil {
+		logger.Error("could not move the spool job", "file", name, "to", target, "err", merr)
+	}
+	os.Remove(s.ownerPath(name))
+}
+
+// release puts a claimed job file back in the spool
+func (s *spool) release(name string) {
+	err := os.Rename(filepath.Join(s.dir, "processing", name), filepath.Join(s.dir, name))
+	if err != nil {
+		logger.Error("could not release the spool job", "file", name, "err", err)
+	}
+	os.Remove(s.ownerPath(name))
+}
+
+// next claims the oldest pending job, false if there is none
+func (s *spool) next() (queuedJob, bool, error) {
+	names, err := s.pending()
+	if err != nil {
+		return queuedJob{}, false, err
+	}
+	for _, name := range names {
+		job, ok, err := s.claim(name)
+		if err != nil {
+			return queuedJob{}, false, err
+		}
+		if ok {
+			return job, true, nil
+		}
+	}
+	return queuedJob{}, false, nil
+}
+
+// Run sends the spool jobs to jobs, claiming one only when ready says a job
+// can start, until ctx is done. It checks in as "spool".
+func (s *spool) Run(ctx context.Context, jobs chan<- queuedJob, ready func() bool) {
+	defer close(jobs)
+	defer liveness.stop("spool")
+	startup := true
+	for {
+		liveness.beat("spool")
+		err := s.recoverClaims(startup)
+		if err != nil {
+			logger.Error("could not recover the spool claims", "dir", s.dir, "err", err)
+		}
+		startup = false
+		if ready() {
+			job, ok, err := s.next()
+			if err != nil {
+				logger.Error("could not read the spool", "dir", s.dir, "err", err)
+			}
+			if ok {
+				logger.Info("claimed spool job", "job", job.ID, "evidence", job.EvidencePath)
+				if !offer(ctx, jobs, job, "spool") {
+					return
+				}
+				// the job has its slot, another one may fit
+				continue
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.interval):
+		}
+	}
+}
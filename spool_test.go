@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeSpoolJob(t *testing.T, dir, name, contents string, age time.Duration) {
+	p := filepath.Join(dir, name)
+	err := ioutil.WriteFile(p, []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-age)
+	os.Chtimes(p, mtime, mtime)
+}
+
+func readSpoolResult(t *testing.T, p string) spoolResult {
+	j, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result spoolResult
+	err = json.Unmarshal(j, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeSpoolJob(t, dir, "new.job.json", `{"evidencePath": "/data/new.E01"}`, 0)
+	writeSpoolJob(t, dir, "old.job.json", `{"evidencePath": "/data/old.E01", "profile": "fastmode"}`, time.Hour)
+	writeSpoolJob(t, dir, "bad.job.json", `{"evidence": "/data/bad.E01"}`, 2*time.Hour)
+	writeSpoolJob(t, dir, "notes.txt", `not a job`, 3*time.Hour)
+
+	s, err := newSpool(dir, Job{OutputPath: "SARD", Profile: "forensic"}, time.Second, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, ok, err := s.next()
+	if err != nil || !ok {
+		t.Fatalf("expected a job, got: %v %v", ok, err)
+	}
+	if job.ID != "old" || job.Profile != "fastmode" || job.OutputPath != "SARD" {
+		t.Errorf("expected the oldest valid job with defaults, got: %+v", job.Job)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "processing", "old.job.json")); err != nil {
+		t.Errorf("expected the job to be claimed: %v", err)
+	}
+	result := readSpoolResult(t, filepath.Join(dir, "failed", "bad.result.json"))
+	if result.Status != "failed" || result.Reason != "validation" {
+		t.Errorf("expected the invalid job to fail validation, got: %+v", result)
+	}
+
+	// another worker lost the race for the same file
+	if _, ok, err := s.claim("old.job.json"); ok || err != nil {
+		t.Errorf("expected a claimed job not to be claimed again, got: %v %v", ok, err)
+	}
+
+	job.finished(nil)
+	result = readSpoolResult(t, filepath.Join(dir, "done", "old.result.json"))
+	if result.Status != "done" || result.ID != "old" || result.Worker == "" {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "done", "old.job.json")); err != nil {
+		t.Errorf("expected the job file in done/: %v", err)
+	}
+
+	job, _, _ = s.next()
+	job.finished(failure("iped", fmt.Errorf("exit status 1")))
+	result = readSpoolResult(t, filepath.Join(dir, "failed", "new.result.json"))
+	if result.Status != "failed" || result.Reason != "iped" || result.Error != "exit status 1" {
+		t.Errorf("unexpected result: %+v", result)
+	}
+}
+
+func TestSpoolRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeSpoolJob(t, dir, "a.job.json", `{"evidencePath": "/data/a.E01"}`, 0)
+	s, err := newSpool(dir, Job{}, 10*time.Millisecond, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	jobs := make(chan queuedJob)
+	go s.Run(ctx, jobs, func() bool { return true })
+	// nobody takes the job, stopping puts it back
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := <-jobs; ok {
+		t.Fatal("expected jobs to be closed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.job.json")); err != nil {
+		t.Errorf("expected the job back in the spool: %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	jobs = make(chan queuedJob)
+	go s.Run(ctx, jobs, func() bool { return true })
+	job := <-jobs
+	if job.EvidencePath != "/data/a.E01" {
+		t.Errorf("unexpected job: %+v", job.Job)
+	}
+}
+
+func TestSpoolRecoverClaims(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := newSpool(dir, Job{}, time.Second, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	processing := filepath.Join(dir, "processing")
+	claims := []struct {
+		name   string
+		worker string
+		age    time.Duration
+	}{
+		{"mine", s.hostname, 0},
+		{"other", "worker2", 0},
+		{"stale", "worker2", time.Hour},
+	}
+	for _, c := range claims {
+		writeSpoolJob(t, processing, c.name+spoolSuffix, `{"evidencePath": "/data/hd.E01"}`, 0)
+		writeSpoolJob(t, processing, c.name+ownerSuffix, fmt.Sprintf(`{"worker": %q}`, c.worker), c.age)
+	}
+	writeSpoolJob(t, processing, "orphan"+spoolSuffix, `{"evidencePath": "/data/hd.E01"}`, 0)
+
+	err = s.recoverClaims(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"mine": dir, "other": processing, "stale": dir, "orphan": processing}
+	for name, in := range expected {
+		if _, err := os.Stat(filepath.Join(in, name+spoolSuffix)); err != nil {
+			t.Errorf("expected %s in %s: %v", name, in, err)
+		}
+	}
+	for _, name := range []string{"mine", "stale"} {
+		if _, err := os.Stat(filepath.Join(processing, name+ownerSuffix)); !os.IsNotExist(err) {
+			t.Errorf("expected the owner file of %s to be removed, got: %v", name, err)
+		}
+	}
+	owner, _, err := s.readOwner("orphan" + spoolSuffix)
+	if err != nil || owner.Worker != "" {
+		t.Errorf("expected a lease without a worker for the orphan claim, got: %+v %v", owner, err)
+	}
+
+	// only startup requeues the claims of this host
+	os.Remove(filepath.Join(dir, "mine"+spoolSuffix))
+	job, ok, err := s.claim("stale" + spoolSuffix)
+	if err != nil || !ok {
+		t.Fatalf("expected a claim, got: %v %v", ok, err)
+	}
+	defer job.finished(nil)
+	s.recoverClaims(false)
+	if _, err := os.Stat(filepath.Join(processing, "stale"+spoolSuffix)); err != nil {
+		t.Errorf("expected a running claim to be kept: %v", err)
+	}
+}
+
+func TestSpoolRenewClaim(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := newSpool(dir, Job{}, time.Second, 60*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeSpoolJob(t, dir, "a.job.json", `{"evidencePath": "/data/a.E01"}`, 0)
+	job, ok, err := s.claim("a.job.json")
+	if err != nil || !ok {
+		t.Fatalf("expected a claim, got: %v %v", ok, err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	s.recoverClaims(false)
+	if _, err := os.Stat(filepath.Join(dir, "processing", "a.job.json")); err != nil {
+		t.Errorf("expected a renewed claim to be kept: %v", err)
+	}
+	job.finished(nil)
+	if _, err := os.Stat(s.ownerPath("a.job.json")); !os.IsNotExist(err) {
+		t.Errorf("expected the owner file to be removed, got: %v", err)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// job phases reported by /status
+const (
+	phaseValidating     = "validating"
+	phaseLocked         = "locked"
+	phaseRunning        = "running"
+	phasePostProcessing = "post-processing"
+	phaseMoving         = "moving"
+)
+
+// workerState tracks the jobs of a worker for /status
+type workerState struct {
+	mu          sync.Mutex
+	jobs        map[string]*jobStatus
+	queued      int
+	lockURL     string
+	notifierURL string
+	// notifier and locker are the last probes of the services
+	notifier serviceStatus
+	locker   serviceStatus
+}
+
+// jobStatus is the state of a running job
+type jobStatus struct {
+	state        *workerState
+	ID           string     `json:"id"`
+	EvidencePath string     `json:"evidencePath"`
+	Slot         int        `json:"slot"`
+	Phase        string     `json:"phase"`
+	StartTime    time.Time  `json:"startTime"`
+	LastProgress *time.Time `json:"lastProgress,omitempty"`
+	Processed    float64    `json:"processed"`
+	Found        float64    `json:"found"`
+	CaseFolder   string     `json:"caseFolder,omitempty"`
+	LogPath      string     `json:"log,omitempty"`
+	DiskFree     *uint64    `json:"diskFree,omitempty"`
+	// IpedPhases are the IPED phases reached so far
+	IpedPhases []phaseTransition `json:"ipedPhases,omitempty"`
+}
+
+type serviceStatus struct {
+	URL       string     `json:"url"`
+	Reachable bool       `json:"reachable"`
+	Error     string     `json:"error,omitempty"`
+	CheckedAt *time.Time `json:"checkedAt,omitempty"`
+}
+
+type statusReport struct {
+	Jobs     []jobStatus   `json:"jobs"`
+	Queue    int           `json:"queue"`
+	Capacity capacity      `json:"capacity"`
+	Notifier serviceStatus `json:"notifier"`
+	Locker   serviceStatus `json:"locker"`
+}
+
+func newWorkerState(lockURL, notifierURL string) *workerState {
+	return &workerState{
+		jobs:        map[string]*jobStatus{},
+		lockURL:     lockURL,
+		notifierURL: notifierURL,
+		notifier:    serviceStatus{URL: notifierURL, Error: "not checked yet"},
+		locker:      serviceStatus{URL: lockURL, Error: "not checked yet"},
+	}
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *workerState) setQueued(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queued = n
+}
+
+// start tracks a job until finish is called
+func (s *workerState) start(id, evidencePath string, slot int) *jobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j := &jobStatus{
+		state:        s,
+		ID:           id,
+		EvidencePath: evidencePath,
+		Slot:         slot,
+		Phase:        phaseValidating,
+		StartTime:    time.Now(),
+	}
+	s.jobs[id] = j
+	return j
+}
+
+func (j *jobStatus) finish() {
+	if j == nil {
+		return
+	}
+	j.state.mu.Lock()
+	defer j.state.mu.Unlock()
+	delete(j.state.jobs, j.ID)
+}
+
+func (j *jobStatus) setPhase(phase string) {
+	if j == nil {
+		return
+	}
+	j.state.mu.Lock()
+	defer j.state.mu.Unlock()
+	j.Phase = phase
+}
+
+func (j *jobStatus) setCaseFolder(folder string) {
+	if j == nil {
+		return
+	}
+	j.state.mu.Lock()
+	defer j.state.mu.Unlock()
+	j.CaseFolder = folder
+}
+
+func (j *jobStatus) setLogPath(logPath string) {
+	if j == nil {
+		return
+	}
+	j.state.mu.Lock()
+	defer j.state.mu.Unlock()
+	j.LogPath = logPath
+}
+
+func (j *jobStatus) setIpedPhase(phase string, at time.Time) {
+	if j == nil {
+		return
+	}
+	j.state.mu.Lock()
+	defer j.state.mu.Unlock()
+	j.IpedPhases = append(j.IpedPhases, phaseTransition{Phase: phase, Time: at})
+}
+
+func (j *jobStatus) progress(processed, found float64) {
+	if j == nil {
+		return
+	}
+	j.state.mu.Lock()
+	defer j.state.mu.Unlock()
+	now := time.Now()
+	j.LastProgress = &now
+	j.Processed = processed
+	j.Found = found
+}
+
+// snapshot copies the state so it can be reported without holding the lock
+func (s *workerState) snapshot() ([]jobStatus, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]jobStatus, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, *j)
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].Slot < jobs[b].Slot })
+	return jobs, s.queued
+}
+
+// job returns a copy of the status of a running job
+func (s *workerState) job(id string) (jobStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return jobStatus{}, false
+	}
+	return *j, true
+}
+
+// current returns the running job in the lowest slot
+func (s *workerState) current() (jobStatus, bool) {
+	jobs, _ := s.snapshot()
+	if len(jobs) == 0 {
+		return jobStatus{}, false
+	}
+	return jobs[0], true
+}
+
+// probe tells whether a service answers HTTP at all
+func probe(URL string) serviceStatus {
+	client := http.Client{Timeout: 2 * time.Second}
+	status := serviceStatus{URL: URL}
+	if URL == "" {
+		status.Error = "not configured"
+		return status
+	}
+	resp, err := client.Get(URL)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	resp.Body.Close()
+	status.Reachable = true
+	return status
+}
+
+// checkServices probes the notifier and the locker for /status
+func (s *workerState) checkServices() {
+	notifier, locker := probe(s.notifierURL), probe(s.lockURL)
+	now := time.Now()
+	notifier.CheckedAt, locker.CheckedAt = &now, &now
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.notifier, s.locker = notifier, locker
+}
+
+// checkServicesEvery probes the services every interval until ctx is done,
+// so /status does not wait for them
+func (s *workerState) checkServicesEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.checkServices()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// services are the last probes of the notifier and the locker
+func (s *workerState) services() (serviceStatus, serviceStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.notifier, s.locker
+}
+
+func statusHandler(state *workerState, scheduler *slotScheduler) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		jobs, queued := state.snapshot()
+		for i := range jobs {
+			if jobs[i].CaseFolder == "" {
+				continue
+			}
+			free, err := diskFree(jobs[i].CaseFolder)
+			if err == nil {
+				jobs[i].DiskFree = &free
+			}
+		}
+		report := statusReport{
+			Jobs:     jobs,
+			Queue:    queued,
+			Capacity: scheduler.capacity(),
+		}
+		report.Notifier, report.Locker = state.services()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusHandler(t *testing.T) {
+	services := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer services.Close()
+
+	state := newWorkerState(services.URL, "http://127.0.0.1:1")
+	scheduler := newSlotScheduler(services.URL, 2, jobResources{}, jobResources{})
+	state.setQueued(3)
+	job := state.start("job1", "/data/mat1/image.E01", 1)
+	job.setPhase(phaseRunning)
+	job.progress(10, 20)
+	state.checkServices()
+
+	rec := httptest.NewRecorder()
+	statusHandler(state, scheduler)(rec, httptest.NewRequest("GET", "/status", nil))
+	report := statusReport{}
+	err := json.NewDecoder(rec.Body).Decode(&report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Jobs) != 1 {
+		t.Fatalf("expected: 1 job, got: %v", report.Jobs)
+	}
+	got := report.Jobs[0]
+	if got.ID != "job1" || got.Phase != phaseRunning || got.Processed != 10 || got.Found != 20 || got.LastProgress == nil {
+		t.Errorf("unexpected job status: %+v", got)
+	}
+	if report.Queue != 3 {
+		t.Errorf("expected: queue 3, got: %v", report.Queue)
+	}
+	if !report.Locker.Reachable || report.Notifier.Reachable || report.Locker.CheckedAt == nil {
+		t.Errorf("unexpected reachability: %+v %+v", report.Locker, report.Notifier)
+	}
+
+	job.finish()
+	jobs, _ := state.snapshot()
+	if len(jobs) != 0 {
+		t.Errorf("expected no jobs, got: %v", jobs)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tracing is the tracer of the worker, spans are dropped until an exporter
+// is set
+var tracing = &tracer{serviceName: "ipedworker"}
+
+// span kinds of OTLP
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+)
+
+// span is a timed operation of a trace
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	// sampled spans are exported, the others only carry the trace context
+	sampled    bool
+	traceState string
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	mu         sync.Mutex
+	attributes [][2]string
+	err        error
+}
+
+// spanExporter sends finished spans somewhere
+type spanExporter interface {
+	export(spans []*span) error
+}
+
+type tracer struct {
+	mu          sync.Mutex
+	serviceName string
+	exporter    spanExporter
+	pending     []*span
+	flushing    chan struct{}
+}
+
+type spanContextKey struct{}
+
+// startSpan starts a span, child of the span in ctx if there is one
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	s := &span{
+		tracer: tracing,
+		name:   name,
+		kind:   spanKindInternal,
+		start:  time.Now(),
+	}
+	if parent, ok := ctx.Value(spanContextKey{}).(*span); ok {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+		s.sampled = parent.sampled
+		s.traceState = parent.traceState
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = true
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+// traceParentPart matches the fields of a traceparent, lowercase hex only
+var traceParentPart = regexp.MustCompile(`^[0-9a-f]+$`)
+
+// withTraceParent returns a context whose spans continue the trace of W3C
+// traceparent and tracestate headers, or ctx if traceparent is not valid.
+// The spans are exported only if the sampled flag is set. Versions after
+// 00 are read as 00, ignoring the fields they add.
+func withTraceParent(ctx context.Context, traceparent, tracestate string) context.Context {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return ctx
+	}
+	for _, part := range parts[:4] {
+		if !traceParentPart.MatchString(part) {
+			return ctx
+		}
+	}
+	if parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return ctx
+	}
+	remote := &span{traceState: strings.TrimSpace(tracestate)}
+	hex.Decode(remote.traceID[:], []byte(parts[1]))
+	hex.Decode(remote.spanID[:], []byte(parts[2]))
+	if remote.traceID == [16]byte{} || remote.spanID == [8]byte{} {
+		return ctx
+	}
+	flags, _ := hex.DecodeString(parts[3])
+	remote.sampled = flags[0]&1 == 1
+	return context.WithValue(ctx, spanContextKey{}, remote)
+}
+
+// injectTraceContext sets the W3C traceparent and tracestate headers of the
+// span in ctx
+func injectTraceContext(ctx context.Context, header http.Header) {
+	s, ok := ctx.Value(spanContextKey{}).(*span)
+	if !ok {
+		return
+	}
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	header.Set("traceparent", fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]), flags))
+	if s.traceState != "" {
+		header.Set("tracestate", s.traceState)
+	}
+}
+
+func (s *span) setAttribute(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes = append(s.attributes, [2]string{key, value})
+}
+
+// finish ends the span, failed if err is not nil
+func (s *span) finish(err error) {
+	s.mu.Lock()
+	s.end = time.Now()
+	s.err = err
+	s.mu.Unlock()
+	s.tracer.add(s)
+}
+
+func (t *tracer) setExporter(serviceName string, exporter spanExporter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.serviceName = serviceName
+	t.exporter = exporter
+}
+
+// add queues a finished span, exporting in the background once there are
+// enough of them
+func (t *tracer) add(s *span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.exporter == nil || !s.sampled {
+		return
+	}
+	t.pending = append(t.pending, s)
+	if len(t.pending) >= 64 && t.flushing == nil {
+		t.flushing = make(chan struct{})
+		go t.flushAsync()
+	}
+}
+
+func (t *tracer) flushAsync() {
+	t.flush()
+	t.mu.Lock()
+	close(t.flushing)
+	t.flushing = nil
+	t.mu.Unlock()
+}
+
+// flush exports the pending spans
+func (t *tracer) flush() {
+	t.mu.Lock()
+	spans := t.pending
+	t.pending = nil
+	exporter := t.exporter
+	t.mu.Unlock()
+	if exporter == nil || len(spans) == 0 {
+		return
+	}
+	err := exporter.export(spans)
+	if err != nil {
+		logger.Warn("could not export spans", "err", err)
+	}
+}
+
+// flushEvery exports the pending spans periodically until ctx is done
+func (t *tracer) flushEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.flush()
+		}
+	}
+}
+
+// shutdown waits for a background export and exports what is left
+func (t *tracer) shutdown() {
+	t.mu.Lock()
+	flushing := t.flushing
+	t.mu.Unlock()
+	if flushing != nil {
+		<-flushing
+	}
+	t.flush()
+}
+
+// OTLP/JSON encoding of spans, see opentelemetry-proto
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func (s *span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Status:            otlpStatus{Code: 1},
+	}
+	if s.parentID != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for _, kv := range s.attributes {
+		o.Attributes = append(o.Attributes, otlpAttribute{Key: kv[0], Value: otlpValue{StringValue: kv[1]}})
+	}
+	if s.err != nil {
+		o.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+	}
+	return o
+}
+
+func otlpRequest(serviceName string, spans []*span) otlpTraces {
+	rs := otlpResourceSpans{}
+	rs.Resource.Attributes = []otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: serviceName}}}
+	ss := otlpScopeSpans{}
+	ss.Scope.Name = "github.com/iped-docker/worker-go"
+	for _, s := range spans {
+		ss.Spans = append(ss.Spans, s.otlp())
+	}
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{rs}}
+}
+
+// newSpanExporter creates the exporter named by kind: otlp, console (stdout),
+// file or none
+func newSpanExporter(kind, endpoint, file, serviceName string) (spanExporter, error) {
+	switch kind {
+	case "", "none":
+		return nil, nil
+	case "otlp":
+		if endpoint == "" {
+			return nil, fmt.Errorf("the otlp exporter needs an endpoint")
+		}
+		return newOTLPExporter(endpoint, serviceName), nil
+	case "console", "stdout":
+		return &writerExporter{serviceName: serviceName, Writer: os.Stdout}, nil
+	case "file":
+		if file == "" {
+			return nil, fmt.Errorf("the file exporter needs a file")
+		}
+		f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return &writerExporter{serviceName: serviceName, Writer: f}, nil
+	}
+	return nil, fmt.Errorf("unknown traces exporter %q, valid exporters are otlp, console, file, none", kind)
+}
+
+// otlpExporter posts spans to an OTLP/HTTP endpoint in JSON
+type otlpExporter struct {
+	URL         string
+	serviceName string
+	client      http.Client
+}
+
+func newOTLPExporter(endpoint, serviceName string) *otlpExporter {
+	URL := strings.TrimRight(endpoint, "/")
+	if !strings.HasSuffix(URL, "/v1/traces") {
+		URL += "/v1/traces"
+	}
+	return &otlpExporter{
+		URL:         URL,
+		serviceName: serviceName,
+		client:      http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (e *otlpExporter) export(spans []*span) error {
+	j, err := json.Marshal(otlpRequest(e.serviceName, spans))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.URL, "application/json", bytes.NewBuffer(j))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("response from OTLP endpoint not ok: %s", resp.Status)
+	}
+	return nil
+}
+
+// writerExporter writes one OTLP/JSON request per line, for offline use
+type writerExporter struct {
+	mu          sync.Mutex
+	serviceName string
+	Writer      io.Writer
+}
+
+func (e *writerExporter) export(spans []*span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	j, err := json.Marshal(otlpRequest(e.serviceName, spans))
+	if err != nil {
+		return err
+	}
+	_, err = e.Writer.Write(append(j, '\n'))
+	return err
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*span
+}
+
+func (r *spanRecorder) export(spans []*span) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func TestTraceContextPropagation(t *testing.T) {
+	var traceparent, tracestate string
+	notifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent, tracestate = r.Header.Get("traceparent"), r.Header.Get("tracestate")
+	}))
+	defer notifier.Close()
+	recorder := &spanRecorder{}
+	tracing.setExporter("test", recorder)
+	defer tracing.setExporter("ipedworker", nil)
+
+	remote := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx := withTraceParent(context.Background(), remote, "vendor=abc")
+	ctx, job := startSpan(ctx, "job")
+	err := sendEvent(ctx, notifier.URL, event{Type: "running"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.finish(nil)
+	tracing.flush()
+
+	if len(recorder.spans) != 2 {
+		t.Fatalf("expected 2 spans, got: %d", len(recorder.spans))
+	}
+	post, exported := recorder.spans[0].otlp(), recorder.spans[1].otlp()
+	if exported.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || exported.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("expected the job span to continue the remote trace, got: %+v", exported)
+	}
+	if post.Name != "POST running" || post.Kind != spanKindClient || post.ParentSpanID != exported.SpanID {
+		t.Errorf("expected a client span child of the job span, got: %+v", post)
+	}
+	expected := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + post.SpanID + "-01"
+	if traceparent != expected {
+		t.Errorf("expected traceparent: %s, got: %s", expected, traceparent)
+	}
+	if tracestate != "vendor=abc" {
+		t.Errorf("expected tracestate: vendor=abc, got: %s", tracestate)
+	}
+
+	// progress events carry the context of the job, without a span
+	err = sendEvent(ctx, notifier.URL, event{Type: "progress"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracing.flush()
+	if len(recorder.spans) != 2 {
+		t.Errorf("expected no span for the progress event, got: %d spans", len(recorder.spans))
+	}
+	if expected := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + exported.SpanID + "-01"; traceparent != expected {
+		t.Errorf("expected traceparent: %s, got: %s", expected, traceparent)
+	}
+}
+
+func TestUnsampledTraceParent(t *testing.T) {
+	var traceparent string
+	notifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer notifier.Close()
+	recorder := &spanRecorder{}
+	tracing.setExporter("test", recorder)
+	defer tracing.setExporter("ipedworker", nil)
+
+	// a later version with an extra field is read as version 00
+	remote := "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra"
+	ctx, job := startSpan(withTraceParent(context.Background(), remote, ""), "job")
+	err := sendEvent(ctx, notifier.URL, event{Type: "running"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.finish(nil)
+	tracing.flush()
+	if len(recorder.spans) != 0 {
+		t.Errorf("expected unsampled spans not to be exported, got: %d", len(recorder.spans))
+	}
+	if !strings.HasPrefix(traceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || !strings.HasSuffix(traceparent, "-00") {
+		t.Errorf("expected an unsampled traceparent, got: %s", traceparent)
+	}
+}
+
+func TestInvalidTraceParent(t *testing.T) {
+	invalid := []string{
+		"",
+		"00-xyz-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-x1",
+	}
+	for _, tp := range invalid {
+		ctx := context.Background()
+		if withTraceParent(ctx, tp, "") != ctx {
+			t.Errorf("expected %q to be ignored", tp)
+		}
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body otlpTraces
+	var path string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer collector.Close()
+
+	_, sp := startSpan(context.Background(), "move")
+	sp.setAttribute("move.destination", "/cases")
+	sp.finish(nil)
+	_, failed := startSpan(context.Background(), "coreRun")
+	failed.finish(jobError{reason: "iped", err: http.ErrHandlerTimeout})
+	err := newOTLPExporter(collector.URL+"/", "ipedworker").export([]*span{sp, failed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/v1/traces" {
+		t.Errorf("expected /v1/traces, got: %s", path)
+	}
+	if len(body.ResourceSpans) != 1 || body.ResourceSpans[0].Resource.Attributes[0].Value.StringValue != "ipedworker" {
+		t.Fatalf("expected the service name resource, got: %+v", body)
+	}
+	spans := body.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 || spans[0].Attributes[0].Key != "move.destination" || spans[0].Status.Code != 1 {
+		t.Errorf("unexpected spans: %+v", spans)
+	}
+	if spans[1].Status.Code != 2 || !strings.Contains(spans[1].Status.Message, "timeout") {
+		t.Errorf("expected an error status, got: %+v", spans[1].Status)
+	}
+}
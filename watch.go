@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// doneMarker tells that an evidence set finished copying, inside the set
+// folder or next to it as <set>.done
+const doneMarker = ".done"
+
+// handledMarker is written next to a set as <set>.ipedworker.json once it is
+// handled, so a restarted worker does not queue it again
+const handledMarker = ".ipedworker.json"
+
+// changeNotifier signals changes to folders, so new evidence is seen before
+// the next poll
+type changeNotifier interface {
+	add(dir string) error
+	changes() <-chan struct{}
+	Close() error
+}
+
+// setState is what a set had when it was measured: its files, out of IPED
+// case folders, audit logs and markers
+type setState struct {
+	Size    int64     `json:"size"`
+	Files   int       `json:"files"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// setMarker is the content of the handled marker of a set
+type setMarker struct {
+	setState
+	// Status is queued, skipped or failed
+	Status  string    `json:"status"`
+	Job     string    `json:"job,omitempty"`
+	Handled time.Time `json:"handled"`
+	// Changed counts the times the set was queued again because it changed
+	// after it was queued
+	Changed int `json:"changed,omitempty"`
+}
+
+// evidenceSet is a folder below a watched folder, the evidence of a case
+type evidenceSet struct {
+	state setState
+	// since is when the set last changed
+	since time.Time
+	// handled is set once the set is queued, skipped or failed, marker is
+	// how
+	handled bool
+	marker  setMarker
+	watched bool
+}
+
+// watchSource queues a job for each new folder of the watched folders once
+// it is complete: when a .done marker appears or nothing changes in it for
+// the quiet period. A handled set is marked, a set that changes after it was
+// queued is queued again. Sets with an IPED case folder inside them and no
+// marker are taken as already processed. Folders are polled every interval,
+// changes notified by inotify on Linux are polled right away, NFS and others
+// only notify local changes.
+type watchSource struct {
+	mu       sync.Mutex
+	dirs     []string
+	defaults Job
+	quiet    time.Duration
+	interval time.Duration
+	sets     map[string]*evidenceSet
+	pending  []Job
+	notifier changeNotifier
+}
+
+func newWatchSource(dirs []string, defaults Job, quiet, interval time.Duration) *watchSource {
+	return &watchSource{
+		dirs:     dirs,
+		defaults: defaults,
+		quiet:    quiet,
+		interval: interval,
+		sets:     map[string]*evidenceSet{},
+	}
+}
+
+// measureSet measures the files of a set. Folder times are left out, IPED
+// changes them when it creates its case folder in the set.
+func measureSet(dir string) (setState, error) {
+	state := setState{}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && p != dir && isIpedOutput(p) {
+			return filepath.SkipDir
+		}
+		name := info.Name()
+		if !info.Mode().IsRegular() || name == doneMarker || strings.Contains(name, ".audit.jsonl") {
+			return nil
+		}
+		if info.ModTime().After(state.ModTime) {
+			state.ModTime = info.ModTime()
+		}
+		state.Size += info.Size()
+		state.Files++
+		return nil
+	})
+	return state, err
+}
+
+func (a setState) equal(b setState) bool {
+	return a.Size == b.Size && a.Files == b.Files && a.ModTime.Equal(b.ModTime)
+}
+
+func isDone(dir string) bool {
+	for _, marker := range []string{filepath.Join(dir, doneMarker), dir + doneMarker} {
+		if _, err := os.Stat(marker); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func readSetMarker(dir string) (setMarker, error) {
+	var m setMarker
+	j, err := ioutil.ReadFile(filepath.Clean(dir) + handledMarker)
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(j, &m)
+	return m, err
+}
+
+// mark records how a set was handled, logging if it can't, e.g. in a
+// read-only folder where the set is only remembered until a restart
+func (set *evidenceSet) mark(dir, status, job string, now time.Time) {
+	set.handled = true
+	set.marker = setMarker{setState: set.state, Status: status, Job: job, Handled: now, Changed: set.marker.Changed}
+	j, _ := json.MarshalIndent(set.marker, "", "  ")
+	err := ioutil.WriteFile(filepath.Clean(dir)+handledMarker, append(j, '\n'), 0644)
+	if err != nil {
+		logger.Error("could not mark the evidence set", "set", dir, "err", err)
+	}
+}
+
+// scan looks for complete sets, queueing their jobs
+func (s *watchSource) scan(now time.Time) {
+	for _, dir := range s.dirs {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			logger.Error("could not read the watched folder", "dir", dir, "err", err)
+			continue
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			s.check(filepath.Join(dir, entry.Name()), now)
+		}
+	}
+}
+
+func (s *watchSource) check(p string, now time.Time) {
+	state, err := measureSet(p)
+	if err != nil {
+		logger.Warn("could not check the evidence set", "set", p, "err", err)
+		return
+	}
+	set, ok := s.sets[p]
+	if !ok {
+		set = &evidenceSet{since: now}
+		// a marked set was handled before a restart
+		if m, err := readSetMarker(p); err == nil {
+			set.state, set.marker, set.handled = m.setState, m, true
+		}
+		s.sets[p] = set
+	}
+	if s.notifier != nil && !set.watched {
+		err := s.notifier.add(p)
+		if err != nil {
+			logger.Warn("could not watch the evidence set", "set", p, "err", err)
+		}
+		set.watched = true
+	}
+	if !state.equal(set.state) {
+		if set.handled && set.marker.Status == "queued" {
+			logger.Warn("evidence set changed after it was queued, it will be queued again", "set", p, "job", set.marker.Job)
+			set.marker.Changed++
+		}
+		set.state, set.since = state, now
+		// sets that failed are retried once they change too
+		set.handled = false
+	}
+	if set.handled || state.Files == 0 {
+		return
+	}
+	done := isDone(p)
+	if !done && now.Sub(set.since) < s.quiet {
+		return
+	}
+	job, _, err := proposeJob(p, s.defaults)
+	if err != nil {
+		set.mark(p, "failed", "", now)
+		logger.Error("could not discover the evidence of the set", "set", p, "err", err)
+		return
+	}
+	// a case folder inside an unmarked set was left by a worker without
+	// markers
+	if set.marker.Handled.IsZero() && !path.IsAbs(job.OutputPath) && job.OutputPath != "" {
+		folder := caseFolder(ipedParams{evidence: job.EvidencePath, output: job.OutputPath})
+		if strings.HasPrefix(folder, filepath.Clean(p)+string(filepath.Separator)) && isIpedOutput(folder) {
+			set.mark(p, "skipped", "", now)
+			logger.Info("skipping evidence set, its case folder exists", "set", p, "caseFolder", folder)
+			return
+		}
+	}
+	job.ID = newJobID()
+	set.mark(p, "queued", job.ID, now)
+	logger.Info("evidence set complete", "set", p, "job", job.ID, "evidence", job.EvidencePath, "marker", done, "size", state.Size, "changed", set.marker.Changed)
+	s.mu.Lock()
+	s.pending = append(s.pending, job)
+	s.mu.Unlock()
+}
+
+func (s *watchSource) queued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+// next removes the first queued job
+func (s *watchSource) next() (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 {
+		return Job{}, false
+	}
+	job := s.pending[0]
+	s.pending = s.pending[1:]
+	return job, true
+}
+
+func (s *watchSource) Run(ctx context.Context, jobs chan<- queuedJob, ready func() bool) {
+	defer close(jobs)
+	defer liveness.stop("watch")
+	notifier, err := newChangeNotifier()
+	if err != nil {
+		logger.Warn("could not watch the folders, polling them", "err", err)
+	} else {
+		defer notifier.Close()
+		for _, dir := range s.dirs {
+			err := notifier.add(dir)
+			if err != nil {
+				logger.Warn("could not watch the folder, polling it", "dir", dir, "err", err)
+			}
+		}
+		s.notifier = notifier
+	}
+	var changes <-chan struct{}
+	if notifier != nil {
+		changes = notifier.changes()
+	}
+	// check often enough to notice the end of the quiet period
+	wait := s.interval
+	if s.quiet > 0 && s.quiet < wait {
+		wait = s.quiet
+	}
+	for {
+		liveness.beat("watch")
+		s.scan(time.Now())
+		for {
+			job, ok := s.next()
+			if !ok {
+				break
+			}
+			if !offer(ctx, jobs, queuedJob{Job: job, scheduled: make(chan struct{})}, "watch") {
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-changes:
+			if !ok {
+				logger.Warn("stopped watching the folders, polling them")
+				changes = nil
+			}
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,59 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// inotifyNotifier signals changes to the watched folders, not to their
+// subfolders
+type inotifyNotifier struct {
+	// fd is kept apart as File.Fd makes the file blocking
+	fd   int
+	file *os.File
+	c    chan struct{}
+}
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_DELETE | syscall.IN_ATTRIB
+
+func newChangeNotifier() (changeNotifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	// a non-blocking file uses the runtime poller, so Close stops read
+	n := &inotifyNotifier{fd: fd, file: os.NewFile(uintptr(fd), "inotify"), c: make(chan struct{}, 1)}
+	go n.read()
+	return n, nil
+}
+
+func (n *inotifyNotifier) read() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		_, err := n.file.Read(buf)
+		if err != nil {
+			close(n.c)
+			return
+		}
+		select {
+		case n.c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (n *inotifyNotifier) add(dir string) error {
+	_, err := syscall.InotifyAddWatch(n.fd, dir, inotifyMask)
+	return os.NewSyscallError("inotify_add_watch", err)
+}
+
+func (n *inotifyNotifier) changes() <-chan struct{} {
+	return n.c
+}
+
+func (n *inotifyNotifier) Close() error {
+	return n.file.Close()
+}
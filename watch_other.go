@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+func newChangeNotifier() (changeNotifier, error) {
+	return nil, fmt.Errorf("watching folders is not supported on this platform, polling")
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := newWatchSource([]string{dir}, Job{OutputPath: "SARD"}, 10*time.Minute, time.Minute)
+	now := time.Now()
+
+	writeFiles(t, dir, map[string]string{"case1/hd.E01": "0123"})
+	s.scan(now)
+	if s.queued() != 0 {
+		t.Fatal("expected the set to wait for the quiet period")
+	}
+	// still copying
+	writeFiles(t, dir, map[string]string{"case1/hd.E02": "0123"})
+	s.scan(now.Add(9 * time.Minute))
+	s.scan(now.Add(15 * time.Minute))
+	if s.queued() != 0 {
+		t.Fatal("expected a change to restart the quiet period")
+	}
+	s.scan(now.Add(20 * time.Minute))
+	job, ok := s.next()
+	if !ok || job.EvidencePath != filepath.Join(dir, "case1", "hd.E01") || job.ID == "" {
+		t.Fatalf("expected the job of the set, got: %v %+v", ok, job)
+	}
+	s.scan(now.Add(time.Hour))
+	if s.queued() != 0 {
+		t.Error("expected the set to be queued once")
+	}
+
+	// a marker completes the set right away
+	writeFiles(t, dir, map[string]string{"case2/phone.ufdr": "0123"})
+	s.scan(now)
+	writeFiles(t, dir, map[string]string{"case2.done": ""})
+	s.scan(now)
+	if job, ok := s.next(); !ok || job.EvidencePath != filepath.Join(dir, "case2", "phone.ufdr") {
+		t.Errorf("expected the marked set, got: %v %+v", ok, job)
+	}
+
+	// already processed
+	writeFiles(t, dir, map[string]string{"case3/hd.E01": "0123", "case3/SARD/IPED.log": "", "case3/.done": ""})
+	s.scan(now)
+	if s.queued() != 0 {
+		t.Error("expected a set with a case folder to be skipped")
+	}
+}
+
+func TestWatchSourceMarker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{"case1/hd.E01": "0123", "case1/.done": ""})
+	s := newWatchSource([]string{dir}, Job{OutputPath: "SARD"}, 10*time.Minute, time.Minute)
+	now := time.Now()
+	s.scan(now)
+	job, ok := s.next()
+	if !ok {
+		t.Fatal("expected the job of the set")
+	}
+	marker, err := readSetMarker(filepath.Join(dir, "case1"))
+	if err != nil || marker.Status != "queued" || marker.Job != job.ID || marker.Files != 1 {
+		t.Fatalf("expected a queued marker, got: %+v %v", marker, err)
+	}
+
+	// the job writes its case folder and audit log in the set
+	writeFiles(t, dir, map[string]string{"case1/SARD/IPED.log": "log", "case1/SARD.audit.jsonl": "{}"})
+	s.scan(now.Add(time.Hour))
+	if s.queued() != 0 {
+		t.Fatal("expected the output of the job not to change the set")
+	}
+
+	// a restarted worker does not queue it again, even once MV_PATH moved
+	// its case folder away
+	os.RemoveAll(filepath.Join(dir, "case1", "SARD"))
+	s = newWatchSource([]string{dir}, Job{OutputPath: "SARD"}, 10*time.Minute, time.Minute)
+	s.scan(now)
+	s.scan(now.Add(time.Hour))
+	if s.queued() != 0 {
+		t.Fatal("expected a marked set not to be queued after a restart")
+	}
+
+	// a set that changes after it was queued is queued again
+	writeFiles(t, dir, map[string]string{"case1/hd.E02": "0123"})
+	s.scan(now.Add(time.Hour))
+	job, ok = s.next()
+	if !ok || job.EvidencePath != filepath.Join(dir, "case1", "hd.E01") {
+		t.Fatalf("expected the changed set to be queued again, got: %v %+v", ok, job)
+	}
+	marker, _ = readSetMarker(filepath.Join(dir, "case1"))
+	if marker.Changed != 1 || marker.Job != job.ID || marker.Files != 2 {
+		t.Errorf("expected the marker to flag the change, got: %+v", marker)
+	}
+}
+
+func TestWatchSourceAbsoluteOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "cases", "SARD")
+	writeFiles(t, dir, map[string]string{
+		"sets/case1/hd.E01":     "0123",
+		"sets/case1/.done":      "",
+		"sets/case2/phone.ufdr": "0123",
+		"sets/case2/.done":      "",
+		"cases/SARD/IPED.log":   "",
+	})
+	s := newWatchSource([]string{filepath.Join(dir, "sets")}, Job{OutputPath: output}, 10*time.Minute, time.Minute)
+	s.scan(time.Now())
+	if s.queued() != 2 {
+		t.Errorf("expected every set to be queued with an absolute output path, got: %d", s.queued())
+	}
+}
+
+func TestWatchSourceRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := newWatchSource([]string{dir}, Job{OutputPath: "SARD"}, time.Hour, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	jobs := make(chan queuedJob)
+	go s.Run(ctx, jobs, func() bool { return true })
+	time.Sleep(50 * time.Millisecond)
+
+	writeFiles(t, dir, map[string]string{"case1/hd.E01": "0123"})
+	time.Sleep(50 * time.Millisecond)
+	writeFiles(t, dir, map[string]string{"case1/.done": ""})
+	select {
+	case job := <-jobs:
+		if job.EvidencePath != filepath.Join(dir, "case1", "hd.E01") {
+			t.Errorf("unexpected job: %+v", job.Job)
+		}
+	case <-time.After(5 * time.Second):
+		if _, err := newChangeNotifier(); err == nil {
+			t.Error("expected the notified set to be queued")
+		}
+	}
+}